@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/semgrep/semgrep-network-broker/pkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var auditFile string
+var auditKey string
+var historyDirectory string
+var querySince string
+var queryUntil string
+var queryFilter pkg.HistoryQuery
+var queryOutput string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect the audit log and request history",
+}
+
+// auditLogPath returns the audit log path and HMAC key from the flags and config
+func auditLogPath() (string, string, error) {
+	path := auditFile
+	var key string
+	if auditKey != "" {
+		var err error
+		if key, err = pkg.SecretString(auditKey).Resolve(); err != nil {
+			return "", "", fmt.Errorf("--key: %v", err)
+		}
+	}
+	if (path == "" || key == "") && len(configFiles) > 0 {
+		config, err := pkg.LoadConfig(configFiles, deploymentId)
+		if err != nil {
+			return "", "", err
+		}
+		if path == "" {
+			path = config.Inbound.Audit.Path
+		}
+		if key == "" {
+			key, err = config.Inbound.Audit.HMACKey.Resolve()
+			if err != nil {
+				return "", "", fmt.Errorf("audit hmacKey: %v", err)
+			}
+		}
+	}
+	if path == "" {
+		return "", "", fmt.Errorf("no audit log: set --file or inbound.audit.path in the config")
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("no audit hmacKey: set --key or inbound.audit.hmacKey in the config")
+	}
+	return path, key, nil
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verifies the hash chain of the audit log, detecting modified, removed or truncated records",
+	Run: func(cmd *cobra.Command, args []string) {
+		path, key, err := auditLogPath()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		result, err := pkg.VerifyAuditLog(path, key)
+		if err != nil {
+			log.Fatal(fmt.Errorf("audit log verification failed: %v", err))
+		}
+
+		if result.Records == 0 {
+			fmt.Println("OK: audit log is empty")
+			return
+		}
+		fmt.Printf("OK: %d records (%d to %d) in %d files\n", result.Records, result.FirstSeq, result.LastSeq, result.Files)
+		if result.Rotated {
+			fmt.Printf("records before %d have been rotated out\n", result.FirstSeq)
+		}
+	},
+}
+
+// parseQueryTime accepts a duration before now (e.g. 24h) or an RFC 3339 timestamp
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected a duration like 24h or an RFC 3339 timestamp", value)
+	}
+	return t, nil
+}
+
+var auditQueryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "Prints requests from the local request history",
+	Run: func(cmd *cobra.Command, args []string) {
+		directory := historyDirectory
+		if directory == "" && len(configFiles) > 0 {
+			config, err := pkg.LoadConfig(configFiles, deploymentId)
+			if err != nil {
+				log.Fatal(err)
+			}
+			directory = config.Inbound.History.Directory
+		}
+		if directory == "" {
+			log.Fatal("no request history: set --dir or inbound.history.directory in the config")
+		}
+
+		var err error
+		now := time.Now()
+		if queryFilter.Since, err = parseQueryTime(querySince, now); err != nil {
+			log.Fatal(err)
+		}
+		if queryFilter.Until, err = parseQueryTime(queryUntil, now); err != nil {
+			log.Fatal(err)
+		}
+
+		records, err := pkg.QueryHistory(directory, queryFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch queryOutput {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			for _, record := range records {
+				enc.Encode(record)
+			}
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tDECISION\tSTATUS\tMETHOD\tDESTINATION\tLATENCY\tREASON")
+			for _, record := range records {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%.1fms\t%v\n", record.Time.Local().Format(time.RFC3339), record.Decision, record.Status, record.Method, record.Destination, record.LatencyMs, record.Reason)
+			}
+			w.Flush()
+		default:
+			log.Fatalf("unknown output %v (expected table or json)", queryOutput)
+		}
+	},
+}
+
+func init() {
+	auditCmd.PersistentFlags().StringVarP(&auditFile, "file", "f", "", "audit log file (defaults to inbound.audit.path)")
+	auditVerifyCmd.Flags().StringVar(&auditKey, "key", "", "audit log HMAC key as a secret reference, e.g. ${file:/run/secrets/audit-hmac-key} (defaults to inbound.audit.hmacKey)")
+	auditCmd.AddCommand(auditVerifyCmd)
+
+	auditQueryCmd.Flags().StringVar(&historyDirectory, "dir", "", "request history directory (defaults to inbound.history.directory)")
+	auditQueryCmd.Flags().StringVar(&querySince, "since", "", "only show requests after this time, as a duration (e.g. 24h) or an RFC 3339 timestamp")
+	auditQueryCmd.Flags().StringVar(&queryUntil, "until", "", "only show requests before this time, as a duration (e.g. 1h) or an RFC 3339 timestamp")
+	auditQueryCmd.Flags().StringVar(&queryFilter.Host, "host", "", "only show requests to this host (glob patterns like *.example.com are allowed)")
+	auditQueryCmd.Flags().IntVar(&queryFilter.Status, "status", 0, "only show requests with this response status")
+	auditQueryCmd.Flags().StringVar(&queryFilter.Method, "method", "", "only show requests with this HTTP method")
+	auditQueryCmd.Flags().StringVar(&queryFilter.Path, "path", "", "only show requests whose path contains this string")
+	auditQueryCmd.Flags().StringVar(&queryFilter.Decision, "decision", "", "only show allowed or denied requests")
+	auditQueryCmd.Flags().StringVarP(&queryOutput, "output", "o", "table", "output format: table or json")
+	auditCmd.AddCommand(auditQueryCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/semgrep/semgrep-network-broker/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// configWatchInterval is how often the config files are checked for changes when --watch-config is set
+const configWatchInterval = 5 * time.Second
+
+var reloadMutex sync.Mutex
+
+// reloadConfig loads the config files again, on top of the default config fetched at startup, and applies them to
+// the running broker. If the new config is rejected, the broker keeps running with its current config.
+func reloadConfig(config *pkg.Config, defaultConfig []byte, trigger string) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	logger := log.WithField("trigger", trigger)
+	logger.Info("config.reload")
+	next, err := pkg.LoadConfigWithDefault(configFiles, defaultConfig)
+	if err == nil {
+		err = config.Reload(next)
+	}
+	if err != nil {
+		logger.WithError(err).Error("config.reload_rejected")
+	}
+}
+
+type configFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statConfigFiles(files []string) map[string]configFileState {
+	states := make(map[string]configFileState, len(files))
+	for _, file := range files {
+		// a missing file is recorded as the zero state, so that it's reloaded once it's back
+		if info, err := os.Stat(file); err == nil {
+			states[file] = configFileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return states
+}
+
+// watchConfigFiles calls onChange whenever one of the files is modified, until stop is closed
+func watchConfigFiles(files []string, onChange func(), stop <-chan bool) {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	last := statConfigFiles(files)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := statConfigFiles(files)
+			for _, file := range files {
+				if current[file] != last[file] {
+					log.WithField("file", file).Info("config.changed")
+					onChange()
+					break
+				}
+			}
+			last = current
+		}
+	}
+}
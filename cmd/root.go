@@ -18,6 +18,7 @@ import (
 var configFiles []string
 var jsonLog bool
 var deploymentId int
+var watchConfig bool
 
 var rootCmd = &cobra.Command{
 	Use:     "semgrep-network-broker",
@@ -38,8 +39,15 @@ var rootCmd = &cobra.Command{
 			doneCh <- true
 		}()
 
-		// load config(s)
-		config, err := pkg.LoadConfig(configFiles, deploymentId)
+		// load config(s). the default config is only downloaded once, and reused when the config is reloaded
+		var defaultConfig []byte
+		if deploymentId > 0 {
+			var err error
+			if defaultConfig, err = pkg.FetchDefaultConfig(deploymentId); err != nil {
+				log.Panic(err)
+			}
+		}
+		config, err := pkg.LoadConfigWithDefault(configFiles, defaultConfig)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -51,6 +59,25 @@ var rootCmd = &cobra.Command{
 		}
 		defer teardown()
 
+		// reload the config on SIGHUP, and optionally when the config files change, without restarting the tunnel
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		stopReload := make(chan bool)
+		defer close(stopReload)
+		go func() {
+			for {
+				select {
+				case <-stopReload:
+					return
+				case <-hupCh:
+					reloadConfig(config, defaultConfig, "sighup")
+				}
+			}
+		}()
+		if watchConfig {
+			go watchConfigFiles(configFiles, func() { reloadConfig(config, defaultConfig, "file_change") }, stopReload)
+		}
+
 		// wait for shutdown
 		<-doneCh
 	},
@@ -77,11 +104,31 @@ func StartNetworkBroker(config *pkg.Config) (func() error, error) {
 
 	// start inbound proxy (r2c --> customer)
 	if err := config.Inbound.Start(tnet); err != nil {
+		closeInbound(config)
 		teardown()
 		return nil, fmt.Errorf("failed to start inbound proxy: %v", err)
 	}
 
-	return teardown, nil
+	// start the local admin API, if configured
+	adminTeardown, err := config.StartAdmin()
+	if err != nil {
+		closeInbound(config)
+		teardown()
+		return nil, fmt.Errorf("failed to start admin API: %v", err)
+	}
+
+	return func() error {
+		adminTeardown()
+		closeInbound(config)
+		return teardown()
+	}, nil
+}
+
+// closeInbound closes the audit log and request history, which may have been opened even if the inbound proxy failed to start
+func closeInbound(config *pkg.Config) {
+	if err := config.Inbound.Close(); err != nil {
+		log.WithError(err).Warn("audit.close_error")
+	}
 }
 
 func Execute() {
@@ -95,4 +142,5 @@ func init() {
 	rootCmd.PersistentFlags().StringArrayVarP(&configFiles, "config", "c", nil, "config file(s)")
 	rootCmd.PersistentFlags().BoolVarP(&jsonLog, "json-log", "j", false, "JSON log output")
 	rootCmd.PersistentFlags().IntVarP(&deploymentId, "deployment-id", "d", 0, "Semgrep deployment ID")
+	rootCmd.Flags().BoolVar(&watchConfig, "watch-config", false, "reload the config when the config files change")
 }
@@ -47,6 +47,17 @@ func mustGetFreePort() int {
 	return l.Addr().(*net.TCPAddr).Port
 }
 
+// waitForPort waits for a server started in the background to start listening on a local port
+func waitForPort(t *testing.T, port int) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", port)); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	t.Fatalf("nothing is listening on port %v", port)
+}
+
 type testClient struct {
 	PeerAddress netip.Addr
 	Client      *http.Client
@@ -155,6 +166,18 @@ func TestWireguardInboundProxy(t *testing.T) {
 	defer remoteWireguardTeardown()
 	log.Info("Remote wireguard peer is up")
 
+	// serve heartbeats on the "remote" side of the tunnel
+	heartbeatServer := gin.New()
+	heartbeatServer.GET("/ping", func(ctx *gin.Context) {
+		ctx.String(200, "pong")
+	})
+	heartbeatListener, err := remoteWireguard.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Errorf("Failed to start heartbeat listener: %v", err)
+	}
+	defer heartbeatListener.Close()
+	go heartbeatServer.RunListener(heartbeatListener)
+
 	// set up internal service (the thing that the broker proxies to)
 	internalServer := gin.Default()
 
@@ -174,6 +197,9 @@ func TestWireguardInboundProxy(t *testing.T) {
 	internalServer.Any("/allowed-path/:path", func(ctx *gin.Context) {
 		ctx.String(200, "Hello %v", ctx.GetString("path"))
 	})
+	internalServer.Any("/allowed-query", func(ctx *gin.Context) {
+		ctx.String(200, "Hello")
+	})
 	internalServer.Any("/introspect/query-params", func(ctx *gin.Context) {
 		ctx.String(200, ctx.Request.URL.RawQuery)
 	})
@@ -187,6 +213,7 @@ func TestWireguardInboundProxy(t *testing.T) {
 	log.Info("Internal server is up")
 
 	internalServerBaseUrl := fmt.Sprintf("http://%v", internalListener.Addr().String())
+	healthAddress := fmt.Sprintf("127.0.0.1:%v", mustGetFreePort())
 
 	// start network broker
 	brokerConfig := &pkg.Config{
@@ -215,11 +242,23 @@ func TestWireguardInboundProxy(t *testing.T) {
 					URL:     internalServerBaseUrl + "/allowed-path/:path",
 					Methods: pkg.ParseHttpMethods([]string{"POST"}),
 				},
+				{
+					URL:         internalServerBaseUrl + "/allowed-query",
+					Methods:     pkg.ParseHttpMethods([]string{"GET"}),
+					QueryParams: []pkg.QueryParamRule{{Name: "ref", Pattern: "[a-z]+"}},
+				},
 				{
 					URL:     internalServerBaseUrl + "/introspect/*",
 					Methods: pkg.ParseHttpMethods([]string{"GET", "POST"}),
 				},
 			},
+			Denylist: []pkg.AllowlistItem{
+				{
+					URL:        internalServerBaseUrl + "/allowed-path/:path",
+					Methods:    pkg.ParseHttpMethods([]string{"POST"}),
+					PathParams: []pkg.PathParamRule{{Name: "path", OneOf: []string{"secret"}}},
+				},
+			},
 			Heartbeat: pkg.HeartbeatConfig{
 				URL: fmt.Sprintf("http://[%v]/ping", gatewayWireguardAddress),
 			},
@@ -227,6 +266,9 @@ func TestWireguardInboundProxy(t *testing.T) {
 				LogRequestBody:  true,
 				LogResponseBody: true,
 			},
+			Health: pkg.HealthConfig{
+				ListenAddress: healthAddress,
+			},
 		},
 	}
 	defaults.SetDefaults(brokerConfig)
@@ -266,8 +308,37 @@ func TestWireguardInboundProxy(t *testing.T) {
 	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/proxy/%v/allowed-post", clientWireguardAddress, internalServerBaseUrl), 403)
 	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/proxy/https://google.com", clientWireguardAddress), 403)
 
+	// it should reject requests that match the denylist, even if they match the allowlist
+	remoteHttpClient.AssertStatusCode(t, "POST", fmt.Sprintf("http://[%v]/proxy/%v/allowed-path/secret", clientWireguardAddress, internalServerBaseUrl), 403)
+
+	// it should enforce query param rules
+	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/proxy/%v/allowed-query?ref=main", clientWireguardAddress, internalServerBaseUrl), 200)
+	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/proxy/%v/allowed-query?ref=main&foo=bar", clientWireguardAddress, internalServerBaseUrl), 403)
+	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/proxy/%v/allowed-query?ref=MAIN", clientWireguardAddress, internalServerBaseUrl), 403)
+
 	// it should include query params in the proxied request
 	remoteHttpClient.AssertStatusAndContent(t, "GET", fmt.Sprintf("http://[%v]/proxy/%v/introspect/query-params?foo=bar", clientWireguardAddress, internalServerBaseUrl), 200, "foo=bar")
+
+	// it should be live and ready, but only report it outside of the tunnel
+	localHttpClient := testClient{Client: &http.Client{Timeout: 1 * time.Second}}
+	localHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://%v/livez", healthAddress), 200)
+	localHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://%v/readyz", healthAddress), 200)
+	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/livez", clientWireguardAddress), 404)
+	remoteHttpClient.AssertStatusCode(t, "GET", fmt.Sprintf("http://[%v]/readyz", clientWireguardAddress), 404)
+
+	// it should label proxy metrics by allowlist item rather than by path
+	metricsReq, _ := http.NewRequest("GET", fmt.Sprintf("http://[%v]/metrics", clientWireguardAddress), nil)
+	_, metrics, err := remoteHttpClient.Request(metricsReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSeries := fmt.Sprintf(`semgrep_network_broker_proxy_requests_total{allowlist="%v/allowed-path/:path",decision="allowed",host="127.0.0.1",method="POST",status_class="2xx"} 2`, internalServerBaseUrl)
+	if !strings.Contains(metrics, expectedSeries) {
+		t.Errorf("expected metrics to contain %v", expectedSeries)
+	}
+	if strings.Contains(metrics, "foobar") {
+		t.Error("expected metrics not to contain request paths")
+	}
 }
 
 func TestRelay(t *testing.T) {
@@ -320,6 +391,7 @@ func TestRelay(t *testing.T) {
 	if err := relayConfig.Outbound.Start(); err != nil {
 		panic(err)
 	}
+	waitForPort(t, relayPort)
 
 	buildUrl := func(relayName string) *url.URL {
 		url, err := url.Parse(fmt.Sprintf("http://localhost:%v/relay/%v", relayPort, relayName))
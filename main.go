@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/semgrep/semgrep-network-broker/cmd"
+	"github.com/semgrep/semgrep-network-broker/pkg"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/whuang8/redactrus"
@@ -18,6 +19,9 @@ func init() {
 	}
 
 	log.AddHook(rh)
+
+	// redact resolved secrets (e.g. ${env:GITHUB_TOKEN}) and tokens from the config
+	log.AddHook(&pkg.SecretRedactionHook{})
 }
 
 func main() {
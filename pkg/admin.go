@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/semgrep/semgrep-network-broker/build"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminUnixPrefix marks an admin listen address as a unix socket path
+const adminUnixPrefix = "unix:"
+
+var processStartTime = time.Now()
+
+func (config AdminConfig) isUnixSocket() bool {
+	return strings.HasPrefix(config.ListenAddress, adminUnixPrefix)
+}
+
+// Validate makes sure the admin API can only be reached from the machine the broker runs on
+func (config AdminConfig) Validate() error {
+	if config.ListenAddress == "" {
+		return nil
+	}
+	if config.isUnixSocket() {
+		if strings.TrimPrefix(config.ListenAddress, adminUnixPrefix) == "" {
+			return fmt.Errorf("admin listenAddress %v has no socket path", config.ListenAddress)
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("invalid admin listenAddress %v: %v", config.ListenAddress, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin listenAddress %v must be a loopback address or a unix socket", config.ListenAddress)
+	}
+	// anything running on the machine can reach a loopback port, so require a token
+	if config.Token == "" {
+		return fmt.Errorf("admin token is required when listening on %v", config.ListenAddress)
+	}
+	return nil
+}
+
+// authenticate checks the admin token, if there is one. The token is resolved on every request, so it can be rotated.
+func (config AdminConfig) authenticate(c *gin.Context) {
+	if config.Token == "" {
+		return
+	}
+	token, err := config.Token.Resolve()
+	if err != nil {
+		log.WithError(err).Error("admin.token_error")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve admin token"})
+		return
+	}
+	provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+}
+
+type AdminStatus struct {
+	Version       string               `json:"version"`
+	Revision      string               `json:"revision"`
+	BuildTime     string               `json:"buildTime"`
+	StartTime     time.Time            `json:"startTime"`
+	UptimeSeconds int64                `json:"uptimeSeconds"`
+	Readiness     ReadinessStatus      `json:"readiness"`
+	LastHeartbeat *time.Time           `json:"lastHeartbeat"`
+	Peers         []WireguardPeerStats `json:"peers"`
+}
+
+func (config *Config) adminStatus(now time.Time) AdminStatus {
+	status := AdminStatus{
+		Version:       build.Version,
+		Revision:      build.Revision,
+		BuildTime:     build.BuildTime,
+		StartTime:     processStartTime,
+		UptimeSeconds: int64(now.Sub(processStartTime).Seconds()),
+	}
+	if config.Inbound.readiness != nil {
+		status.Readiness = config.Inbound.readiness.check(now)
+	}
+	if lastSuccess := config.Inbound.Heartbeat.lastSuccess(); !lastSuccess.IsZero() {
+		status.LastHeartbeat = &lastSuccess
+	}
+	if monitor := config.Inbound.Wireguard.monitor; monitor != nil {
+		peers, err := monitor.currentStats()
+		if err != nil {
+			log.WithError(err).Warn("wireguard.stats_error")
+		}
+		status.Peers = peers
+	}
+	return status
+}
+
+// brokerCounters returns the current value of each of the broker's metrics, keyed by name and labels
+func brokerCounters() (map[string]float64, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := map[string]float64{}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), metricsNamespace+"_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%v=%q", label.GetName(), label.GetValue()))
+			}
+			sort.Strings(labels)
+			suffix := ""
+			if len(labels) > 0 {
+				suffix = "{" + strings.Join(labels, ",") + "}"
+			}
+
+			switch {
+			case metric.Counter != nil:
+				counters[family.GetName()+suffix] = metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				counters[family.GetName()+suffix] = metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				counters[family.GetName()+"_count"+suffix] = float64(metric.GetHistogram().GetSampleCount())
+				counters[family.GetName()+"_sum"+suffix] = metric.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return counters, nil
+}
+
+// StartAdmin serves the admin API, if it's configured. It's only reachable locally, never through the tunnel.
+func (config *Config) StartAdmin() (func() error, error) {
+	adminConfig := config.Inbound.Admin
+	if adminConfig.ListenAddress == "" {
+		return func() error { return nil }, nil
+	}
+	if err := adminConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	var listener net.Listener
+	var err error
+	if adminConfig.isUnixSocket() {
+		path := strings.TrimPrefix(adminConfig.ListenAddress, adminUnixPrefix)
+		// remove a socket left behind by a previous run
+		os.Remove(path)
+		listener, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+	} else {
+		listener, err = net.Listen("tcp", adminConfig.ListenAddress)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start admin listener: %v", err)
+	}
+
+	r := gin.New()
+	r.Use(LoggerWithConfig(log.StandardLogger(), nil), gin.Recovery(), adminConfig.authenticate)
+
+	r.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, config.adminStatus(time.Now()))
+	})
+	r.GET("/config", func(c *gin.Context) {
+		// secrets are redacted when the config is marshaled
+		c.JSON(http.StatusOK, config.effectiveConfig())
+	})
+	r.GET("/counters", func(c *gin.Context) {
+		counters, err := brokerCounters()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, counters)
+	})
+
+	debug := r.Group("/debug/pprof")
+	debug.GET("/", gin.WrapF(pprof.Index))
+	debug.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	debug.GET("/profile", gin.WrapF(pprof.Profile))
+	debug.Any("/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/trace", gin.WrapF(pprof.Trace))
+	debug.GET("/:name", gin.WrapF(pprof.Index))
+
+	server := &http.Server{Handler: r}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("admin.error")
+		}
+	}()
+	log.WithField("listen", adminConfig.ListenAddress).Info("admin.start")
+
+	return server.Close, nil
+}
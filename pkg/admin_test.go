@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminConfigValidate(t *testing.T) {
+	valid := []AdminConfig{
+		{},
+		{ListenAddress: "127.0.0.1:9090", Token: "admin-token"},
+		{ListenAddress: "localhost:9090", Token: "admin-token"},
+		{ListenAddress: "[::1]:9090", Token: "admin-token"},
+		{ListenAddress: "unix:/run/broker/admin.sock"},
+	}
+	for _, config := range valid {
+		if err := config.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid: %v", config, err)
+		}
+	}
+
+	invalid := []AdminConfig{
+		{ListenAddress: "0.0.0.0:9090", Token: "admin-token"},
+		{ListenAddress: ":9090", Token: "admin-token"},
+		{ListenAddress: "127.0.0.1:9090"},
+		{ListenAddress: "unix:"},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", config)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	config := &Config{Inbound: InboundProxyConfig{
+		Admin:  AdminConfig{ListenAddress: "unix:" + socketPath, Token: "admin-token"},
+		GitLab: &GitLab{BaseURL: "https://gitlab.example.com/api/v4", Token: "glpat-secret-token"},
+	}}
+	teardown, err := config.StartAdmin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	get := func(path string, token string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://admin"+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get("/status", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected a request without a token to be rejected, got %v", status)
+	}
+	if status, _ := get("/status", "wrong-token"); status != http.StatusUnauthorized {
+		t.Errorf("expected a request with the wrong token to be rejected, got %v", status)
+	}
+
+	status, body := get("/status", "admin-token")
+	adminStatus := AdminStatus{}
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &adminStatus) != nil || adminStatus.Version == "" {
+		t.Errorf("unexpected status response: %v %v", status, body)
+	}
+
+	status, body = get("/config", "admin-token")
+	if status != http.StatusOK || strings.Contains(body, "glpat-secret-token") || !strings.Contains(body, "gitlab.example.com") {
+		t.Errorf("expected the config with secrets redacted, got %v %v", status, body)
+	}
+
+	rateLimitExceededCounter.WithLabelValues("admin-test").Inc()
+	status, body = get("/counters", "admin-token")
+	if status != http.StatusOK || !strings.Contains(body, `semgrep_network_broker_rate_limit_exceeded_total{limit=\"admin-test\"}":1`) {
+		t.Errorf("expected counters, got %v %v", status, body)
+	}
+
+	if status, _ := get("/debug/pprof/goroutine?debug=1", "admin-token"); status != http.StatusOK {
+		t.Errorf("expected pprof to be served, got %v", status)
+	}
+}
@@ -1,36 +1,444 @@
 package pkg
 
 import (
+	"fmt"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/ucarion/urlpath"
 )
 
-func (config AllowlistItem) Matches(method string, url *url.URL) bool {
-	m := LookupHttpMethod(method)
-	if m == MethodUnknown || !config.Methods.Test(m) {
-		return false
+const (
+	PathParamTypeString = "string"
+	PathParamTypeInt    = "int"
+)
+
+// compilePattern compiles a rule pattern so that it has to match the entire value
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+}
+
+type compiledQueryParamRule struct {
+	QueryParamRule
+	pattern *regexp.Regexp
+}
+
+func (rule QueryParamRule) compile() (*compiledQueryParamRule, error) {
+	if rule.Required && rule.Forbidden {
+		return nil, fmt.Errorf("query param %v cannot be both required and forbidden", rule.Name)
+	}
+	pattern, err := compilePattern(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for query param %v: %v", rule.Name, err)
+	}
+	return &compiledQueryParamRule{QueryParamRule: rule, pattern: pattern}, nil
+}
+
+func (rule QueryParamRule) Validate() error {
+	_, err := rule.compile()
+	return err
+}
+
+func (rule *compiledQueryParamRule) matchesValue(value string) bool {
+	return rule.pattern == nil || rule.pattern.MatchString(value)
+}
+
+type compiledPathParamRule struct {
+	PathParamRule
+	pattern *regexp.Regexp
+}
+
+func (rule PathParamRule) compile() (*compiledPathParamRule, error) {
+	switch rule.Type {
+	case "", PathParamTypeString, PathParamTypeInt:
+	default:
+		return nil, fmt.Errorf("unknown type for path param %v: %v", rule.Name, rule.Type)
+	}
+	pattern, err := compilePattern(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for path param %v: %v", rule.Name, err)
 	}
+	return &compiledPathParamRule{PathParamRule: rule, pattern: pattern}, nil
+}
 
-	parsedUrl, _ := url.Parse(config.URL)
+func (rule PathParamRule) Validate() error {
+	_, err := rule.compile()
+	return err
+}
 
-	if parsedUrl.Scheme != url.Scheme || parsedUrl.Host != url.Host {
+// matchesValue checks an unescaped path param value against the rule
+func (rule *compiledPathParamRule) matchesValue(value string) bool {
+	if rule.Type == PathParamTypeInt {
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return false
+		}
+	}
+	if len(rule.OneOf) > 0 && !stringInSlice(value, rule.OneOf) {
 		return false
 	}
+	return rule.pattern == nil || rule.pattern.MatchString(value)
+}
 
-	matcher := urlpath.New(parsedUrl.Path)
-	if _, matches := matcher.Match(url.EscapedPath()); matches {
-		return true
+// compiledAllowlistItem is an allowlist item with its URL template parsed and its patterns compiled
+type compiledAllowlistItem struct {
+	item       *AllowlistItem
+	index      int
+	origin     string
+	path       urlpath.Path
+	pathRules  []*compiledPathParamRule
+	queryRules []*compiledQueryParamRule
+	body       *compiledBodyPolicy
+	// deny is set for denylist items, which have to fail closed
+	deny bool
+}
+
+func compileAllowlistItem(item *AllowlistItem, index int) (*compiledAllowlistItem, error) {
+	parsedUrl, err := url.Parse(item.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist url %v: %v", item.URL, err)
+	}
+	if parsedUrl.Scheme == "" || parsedUrl.Host == "" {
+		return nil, fmt.Errorf("allowlist url %v must include a scheme and host", item.URL)
 	}
 
+	compiled := &compiledAllowlistItem{
+		item:   item,
+		index:  index,
+		origin: parsedUrl.Scheme + "://" + parsedUrl.Host,
+		path:   urlpath.New(parsedUrl.Path),
+	}
+
+	for _, rule := range item.PathParams {
+		if !compiled.hasParam(rule.Name) {
+			return nil, fmt.Errorf("path param %v is not in allowlist url %v", rule.Name, item.URL)
+		}
+		compiledRule, err := rule.compile()
+		if err != nil {
+			return nil, err
+		}
+		compiled.pathRules = append(compiled.pathRules, compiledRule)
+	}
+
+	for _, rule := range item.QueryParams {
+		compiledRule, err := rule.compile()
+		if err != nil {
+			return nil, err
+		}
+		compiled.queryRules = append(compiled.queryRules, compiledRule)
+	}
+
+	compiled.body, err = item.Body.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	if item.RateLimit != nil && item.RateLimit.KeyParam != "" && !compiled.hasParam(item.RateLimit.KeyParam) {
+		return nil, fmt.Errorf("rate limit key param %v is not in allowlist url %v", item.RateLimit.KeyParam, item.URL)
+	}
+
+	return compiled, nil
+}
+
+func (item *compiledAllowlistItem) hasParam(name string) bool {
+	for _, segment := range item.path.Segments {
+		if segment.IsParam && segment.Param == name {
+			return true
+		}
+	}
 	return false
 }
 
-func (allowlist Allowlist) FindMatch(method string, url *url.URL) (*AllowlistItem, bool) {
+func (config AllowlistItem) Validate() error {
+	_, err := compileAllowlistItem(&config, 0)
+	return err
+}
+
+func (item *compiledAllowlistItem) matchesQuery(rawQuery string) bool {
+	// no rules means any query string is allowed
+	if len(item.queryRules) == 0 {
+		return true
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// a query string that can't be parsed can't be shown not to match a denylist item
+		return item.deny
+	}
+
+	seen := make(map[string]bool, len(item.queryRules))
+	for _, rule := range item.queryRules {
+		seen[rule.Name] = true
+		values, present := query[rule.Name]
+		if !present {
+			if rule.Required {
+				return false
+			}
+			continue
+		}
+		if rule.Forbidden {
+			return false
+		}
+		for _, value := range values {
+			if !rule.matchesValue(value) {
+				return false
+			}
+		}
+	}
+
+	// other query params never get a request out of the denylist
+	if !item.item.AllowOtherQueryParams && !item.deny {
+		for name := range query {
+			if !seen[name] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// matchesParams checks the path params against the item's path param rules.
+// On success, the unescaped param values are returned.
+func (item *compiledAllowlistItem) matchesParams(segments []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, segment := range item.path.Segments {
+		if !segment.IsParam {
+			continue
+		}
+		value, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return nil, false
+		}
+		params[segment.Param] = value
+	}
+
+	for _, rule := range item.pathRules {
+		if !rule.matchesValue(params[rule.Name]) {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// matchesRequest checks everything but the URL path, which is assumed to already match the item's template
+func (item *compiledAllowlistItem) matchesRequest(method uint, segments []string, rawQuery string) (map[string]string, bool) {
+	if method == MethodUnknown || !item.item.Methods.Test(method) {
+		return nil, false
+	}
+
+	params, matches := item.matchesParams(segments)
+	if !matches {
+		return nil, false
+	}
+
+	if !item.matchesQuery(rawQuery) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// Match checks the request against the allowlist item. On success, the matched path params are returned.
+func (config AllowlistItem) Match(method string, target *url.URL) (map[string]string, bool) {
+	item, err := compileAllowlistItem(&config, 0)
+	if err != nil {
+		return nil, false
+	}
+
+	if item.origin != target.Scheme+"://"+target.Host {
+		return nil, false
+	}
+
+	escapedPath := target.EscapedPath()
+	if _, matches := item.path.Match(escapedPath); !matches {
+		return nil, false
+	}
+
+	return item.matchesRequest(LookupHttpMethod(method), strings.Split(escapedPath, "/"), target.RawQuery)
+}
+
+func (config AllowlistItem) Matches(method string, target *url.URL) bool {
+	_, matches := config.Match(method, target)
+	return matches
+}
+
+// FindMatch returns the first matching allowlist item. It checks every item in order, see Compile for a faster alternative.
+func (allowlist Allowlist) FindMatch(method string, target *url.URL) (*AllowlistMatch, bool) {
+	for i := range allowlist {
+		if params, matches := allowlist[i].Match(method, target); matches {
+			// Match already compiled the item, so this can't fail
+			body, _ := allowlist[i].Body.compile()
+			return &AllowlistMatch{AllowlistItem: &allowlist[i], Params: params, bodyPolicy: body}, true
+		}
+	}
+	return nil, false
+}
+
+// allowlistNode is a node of a path segment trie
+type allowlistNode struct {
+	static map[string]*allowlistNode
+	param  *allowlistNode
+	// items whose template ends at this node
+	items []*compiledAllowlistItem
+	// items whose template ends at this node with a trailing "*"
+	trailing []*compiledAllowlistItem
+}
+
+func (node *allowlistNode) insert(item *compiledAllowlistItem) {
+	for _, segment := range item.path.Segments {
+		key := segment.Const
+		if item.deny {
+			// denylist lookups use normalized segments, see normalizePathSegments
+			key = url.PathEscape(key)
+		}
+		if segment.IsParam {
+			if node.param == nil {
+				node.param = &allowlistNode{}
+			}
+			node = node.param
+		} else {
+			if node.static == nil {
+				node.static = map[string]*allowlistNode{}
+			}
+			child, exists := node.static[key]
+			if !exists {
+				child = &allowlistNode{}
+				node.static[key] = child
+			}
+			node = child
+		}
+	}
+
+	if item.path.Trailing {
+		node.trailing = append(node.trailing, item)
+	} else {
+		node.items = append(node.items, item)
+	}
+}
+
+// collect appends all items whose template matches the path segments, using the same rules as urlpath
+func (node *allowlistNode) collect(segments []string, depth int, candidates []*compiledAllowlistItem) []*compiledAllowlistItem {
+	if depth == len(segments) {
+		return append(candidates, node.items...)
+	}
+
+	// a trailing "*" requires at least one more (possibly empty) segment
+	candidates = append(candidates, node.trailing...)
+
+	if child, exists := node.static[segments[depth]]; exists {
+		candidates = child.collect(segments, depth+1, candidates)
+	}
+	if node.param != nil {
+		candidates = node.param.collect(segments, depth+1, candidates)
+	}
+
+	return candidates
+}
+
+// normalizePathSegments splits an escaped path into segments that don't depend on how the request was encoded:
+// each segment is unescaped and then escaped again, and "." and ".." segments are resolved. Denylist items are
+// matched against these, so that e.g. /projects/secret%2Dinfra or /projects/x/../secret-infra can't get around
+// a denylist item for /projects/secret-infra.
+func normalizePathSegments(escapedPath string) []string {
+	parts := strings.Split(escapedPath, "/")
+	segments := make([]string, 0, len(parts))
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			unescaped = part
+		}
+		switch {
+		case i > 0 && unescaped == ".":
+		case i > 0 && unescaped == "..":
+			// the leading empty segment can't be removed
+			if len(segments) > 1 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, url.PathEscape(unescaped))
+			continue
+		}
+		// a trailing dot segment still ends the path with a "/"
+		if i == len(parts)-1 {
+			segments = append(segments, "")
+		}
+	}
+	return segments
+}
+
+// CompiledAllowlist is an allowlist that has been parsed and indexed by origin and path segment for fast lookups
+type CompiledAllowlist struct {
+	origins map[string]*allowlistNode
+	deny    bool
+}
+
+// Compile parses every allowlist item and builds a lookup trie. Invalid items result in an error.
+func (allowlist Allowlist) Compile() (*CompiledAllowlist, error) {
+	return allowlist.compile(false)
+}
+
+// CompileDenylist is like Compile, but items match any request they can't rule out: other query params are
+// always allowed, a query string that can't be parsed matches items with query param rules, and paths are
+// normalized before matching.
+func (allowlist Allowlist) CompileDenylist() (*CompiledAllowlist, error) {
+	return allowlist.compile(true)
+}
+
+func (allowlist Allowlist) compile(deny bool) (*CompiledAllowlist, error) {
+	compiled := &CompiledAllowlist{origins: map[string]*allowlistNode{}, deny: deny}
+
 	for i := range allowlist {
-		if allowlist[i].Matches(method, url) {
-			return &allowlist[i], true
+		item, err := compileAllowlistItem(&allowlist[i], i)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist item %d: %v", i, err)
 		}
+		item.deny = deny
+
+		root, exists := compiled.origins[item.origin]
+		if !exists {
+			root = &allowlistNode{}
+			compiled.origins[item.origin] = root
+		}
+		root.insert(item)
 	}
+
+	return compiled, nil
+}
+
+// FindMatch returns the first matching allowlist item (in config order)
+func (compiled *CompiledAllowlist) FindMatch(method string, target *url.URL) (*AllowlistMatch, bool) {
+	root, exists := compiled.origins[target.Scheme+"://"+target.Host]
+	if !exists {
+		return nil, false
+	}
+
+	var segments []string
+	if compiled.deny {
+		segments = normalizePathSegments(target.EscapedPath())
+	} else {
+		segments = strings.Split(target.EscapedPath(), "/")
+	}
+	candidates := root.collect(segments, 0, nil)
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	// preserve "first matching item wins" semantics
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].index < candidates[j].index })
+
+	m := LookupHttpMethod(method)
+	for _, candidate := range candidates {
+		if params, matches := candidate.matchesRequest(m, segments, target.RawQuery); matches {
+			return &AllowlistMatch{AllowlistItem: candidate.item, Params: params, bodyPolicy: candidate.body}, true
+		}
+	}
+
 	return nil, false
 }
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"fmt"
 	"net/url"
 	"testing"
 )
@@ -15,10 +16,22 @@ func urlMustParse(rawURL string) *url.URL {
 }
 
 func assertAllowlistMatch(t *testing.T, allowlist *Allowlist, method string, rawURL string, shouldMatch bool) {
-	_, match := allowlist.FindMatch(method, urlMustParse(rawURL))
+	linearMatch, match := allowlist.FindMatch(method, urlMustParse(rawURL))
 	if match != shouldMatch {
 		t.Errorf("%v %v match result was %v, expected %v", method, rawURL, match, shouldMatch)
 	}
+
+	compiled, err := allowlist.Compile()
+	if err != nil {
+		t.Fatalf("failed to compile allowlist: %v", err)
+	}
+	compiledMatch, match := compiled.FindMatch(method, urlMustParse(rawURL))
+	if match != shouldMatch {
+		t.Errorf("%v %v compiled match result was %v, expected %v", method, rawURL, match, shouldMatch)
+	}
+	if match && linearMatch != nil && compiledMatch.AllowlistItem != linearMatch.AllowlistItem {
+		t.Errorf("%v %v compiled match was %v, expected %v", method, rawURL, compiledMatch.URL, linearMatch.URL)
+	}
 }
 
 func TestAllowlistSchemeMatch(t *testing.T) {
@@ -118,3 +131,293 @@ func TestAllowlistPathMatch(t *testing.T) {
 	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/variable-path/bla%2Fbla/suffix", true)
 	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/variable-path/bla/bla/suffix", false)
 }
+
+func TestAllowlistQueryMatch(t *testing.T) {
+	allowlist := &Allowlist{
+		AllowlistItem{
+			URL:     "https://foo.com/any-query",
+			Methods: ParseHttpMethods([]string{"GET"}),
+		},
+		AllowlistItem{
+			URL:         "https://foo.com/only-ref",
+			Methods:     ParseHttpMethods([]string{"GET"}),
+			QueryParams: []QueryParamRule{{Name: "ref"}},
+		},
+		AllowlistItem{
+			URL:     "https://foo.com/required-ref",
+			Methods: ParseHttpMethods([]string{"GET"}),
+			QueryParams: []QueryParamRule{
+				{Name: "ref", Required: true, Pattern: "[a-z]+"},
+				{Name: "page"},
+			},
+		},
+		AllowlistItem{
+			URL:                   "https://foo.com/forbidden-token",
+			Methods:               ParseHttpMethods([]string{"GET"}),
+			QueryParams:           []QueryParamRule{{Name: "private_token", Forbidden: true}},
+			AllowOtherQueryParams: true,
+		},
+	}
+
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/any-query?foo=bar&baz=1", true)
+
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/only-ref", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/only-ref?ref=main", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/only-ref?ref=main&foo=bar", false)
+
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/required-ref", false)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/required-ref?ref=main", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/required-ref?ref=main&page=2", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/required-ref?ref=main&ref=dev", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/required-ref?ref=main&ref=v1.0", false)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/required-ref?ref=main1", false)
+
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/forbidden-token?foo=bar", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/forbidden-token?foo=bar&private_token=x", false)
+}
+
+func TestDenylistQueryMatch(t *testing.T) {
+	denylist := Allowlist{
+		AllowlistItem{
+			URL:         "https://foo.com/files",
+			Methods:     ParseHttpMethods([]string{"GET"}),
+			QueryParams: []QueryParamRule{{Name: "ref", Required: true, Pattern: "secret-.*"}},
+		},
+	}
+	compiled, err := denylist.CompileDenylist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"https://foo.com/files":                         false,
+		"https://foo.com/files?ref=main":                false,
+		"https://foo.com/files?ref=secret-infra":        true,
+		"https://foo.com/files?ref=secret-infra&page=2": true,
+		"https://foo.com/files?ref=secret-infra&x=%zz":  true,
+		"https://foo.com/files?ref=main;x=1":            true,
+	}
+	for rawURL, shouldMatch := range tests {
+		if _, match := compiled.FindMatch("GET", urlMustParse(rawURL)); match != shouldMatch {
+			t.Errorf("%v denylist match result was %v, expected %v", rawURL, match, shouldMatch)
+		}
+	}
+}
+
+func TestDenylistPathEncoding(t *testing.T) {
+	denylist := Allowlist{
+		AllowlistItem{
+			URL:     "https://foo.com/projects/secret-infra",
+			Methods: ParseHttpMethods([]string{"GET"}),
+		},
+		AllowlistItem{
+			URL:        "https://foo.com/repos/:owner/settings",
+			Methods:    ParseHttpMethods([]string{"GET"}),
+			PathParams: []PathParamRule{{Name: "owner", OneOf: []string{"secret org"}}},
+		},
+	}
+	compiled, err := denylist.CompileDenylist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"https://foo.com/projects/secret-infra":             true,
+		"https://foo.com/projects/secret%2Dinfra":           true,
+		"https://foo.com/projects/secret%2dinfra":           true,
+		"https://foo.com/projects/%73ecret-infra":           true,
+		"https://foo.com/projects/./secret-infra":           true,
+		"https://foo.com/projects/x/../secret-infra":        true,
+		"https://foo.com/projects/x/%2E%2E/secret-infra":    true,
+		"https://foo.com/../projects/secret-infra":          true,
+		"https://foo.com/projects/secret-infra2":            false,
+		"https://foo.com/projects/secret-infra/..":          false,
+		"https://foo.com/repos/secret%20org/settings":       true,
+		"https://foo.com/repos/secret%20org/./settings":     true,
+		"https://foo.com/repos/%73ecret%20org/settings":     true,
+		"https://foo.com/repos/public/settings":             false,
+		"https://foo.com/repos/secret%20org/settings/other": false,
+	}
+	for rawURL, shouldMatch := range tests {
+		if _, match := compiled.FindMatch("GET", urlMustParse(rawURL)); match != shouldMatch {
+			t.Errorf("%v denylist match result was %v, expected %v", rawURL, match, shouldMatch)
+		}
+	}
+}
+
+func TestAllowlistPathParamMatch(t *testing.T) {
+	allowlist := &Allowlist{
+		AllowlistItem{
+			URL:     "https://foo.com/repos/:owner/:repo/pulls/:number/comments",
+			Methods: ParseHttpMethods([]string{"POST"}),
+			PathParams: []PathParamRule{
+				{Name: "owner", OneOf: []string{"platform", "payments"}},
+				{Name: "repo", Pattern: "[a-z-]+"},
+				{Name: "number", Type: PathParamTypeInt},
+			},
+		},
+		AllowlistItem{
+			URL:        "https://foo.com/projects/:project",
+			Methods:    ParseHttpMethods([]string{"GET"}),
+			PathParams: []PathParamRule{{Name: "project", Pattern: "platform/.+"}},
+		},
+	}
+
+	assertAllowlistMatch(t, allowlist, "POST", "https://foo.com/repos/platform/api/pulls/12/comments", true)
+	assertAllowlistMatch(t, allowlist, "POST", "https://foo.com/repos/payments/web-app/pulls/1/comments", true)
+	assertAllowlistMatch(t, allowlist, "POST", "https://foo.com/repos/other/api/pulls/12/comments", false)
+	assertAllowlistMatch(t, allowlist, "POST", "https://foo.com/repos/platform/API/pulls/12/comments", false)
+	assertAllowlistMatch(t, allowlist, "POST", "https://foo.com/repos/platform/api/pulls/12a/comments", false)
+
+	// constraints are checked against unescaped values
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/projects/platform%2Fapi", true)
+	assertAllowlistMatch(t, allowlist, "GET", "https://foo.com/projects/secret%2Fapi", false)
+
+	match, _ := allowlist.FindMatch("GET", urlMustParse("https://foo.com/projects/platform%2Fapi"))
+	if match.Params["project"] != "platform/api" {
+		t.Errorf("expected project param to be platform/api, got %v", match.Params["project"])
+	}
+}
+
+func TestAllowlistPathParamValidate(t *testing.T) {
+	item := AllowlistItem{
+		URL:        "https://foo.com/projects/:project",
+		PathParams: []PathParamRule{{Name: "repo"}},
+	}
+	if err := item.Validate(); err == nil {
+		t.Error("expected unknown path param to fail validation")
+	}
+
+	rule := PathParamRule{Name: "project", Type: "uuid"}
+	if err := rule.Validate(); err == nil {
+		t.Error("expected unknown path param type to fail validation")
+	}
+}
+
+func TestAllowlistFirstMatchWins(t *testing.T) {
+	allowlist := Allowlist{
+		AllowlistItem{
+			URL:     "https://foo.com/projects/*",
+			Methods: ParseHttpMethods([]string{"GET"}),
+		},
+		AllowlistItem{
+			URL:     "https://foo.com/projects/:project",
+			Methods: ParseHttpMethods([]string{"GET"}),
+		},
+		AllowlistItem{
+			URL:     "https://foo.com/projects/bar",
+			Methods: ParseHttpMethods([]string{"GET", "POST"}),
+		},
+	}
+
+	compiled, err := allowlist.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, _ := compiled.FindMatch("GET", urlMustParse("https://foo.com/projects/bar"))
+	if match.AllowlistItem != &allowlist[0] {
+		t.Errorf("expected first allowlist item to match, got %v", match.URL)
+	}
+
+	match, _ = compiled.FindMatch("POST", urlMustParse("https://foo.com/projects/bar"))
+	if match.AllowlistItem != &allowlist[2] {
+		t.Errorf("expected third allowlist item to match, got %v", match.URL)
+	}
+
+	assertAllowlistMatch(t, &allowlist, "GET", "https://foo.com/projects", false)
+	assertAllowlistMatch(t, &allowlist, "GET", "https://foo.com/projects/", true)
+	assertAllowlistMatch(t, &allowlist, "GET", "https://foo.com/projects/bar/baz", true)
+}
+
+func TestAllowlistCompileErrors(t *testing.T) {
+	invalidAllowlists := map[string]Allowlist{
+		"unparseable url":     {AllowlistItem{URL: "https://foo.com/%zz"}},
+		"missing host":        {AllowlistItem{URL: "/foo"}},
+		"unknown path param":  {AllowlistItem{URL: "https://foo.com/:a", PathParams: []PathParamRule{{Name: "b"}}}},
+		"invalid path regex":  {AllowlistItem{URL: "https://foo.com/:a", PathParams: []PathParamRule{{Name: "a", Pattern: "("}}}},
+		"invalid query regex": {AllowlistItem{URL: "https://foo.com/", QueryParams: []QueryParamRule{{Name: "a", Pattern: "("}}}},
+	}
+
+	for name, allowlist := range invalidAllowlists {
+		if _, err := allowlist.Compile(); err == nil {
+			t.Errorf("%v: expected compile error", name)
+		}
+	}
+
+	// the linear matcher should not panic on invalid items
+	invalidItem := AllowlistItem{URL: "https://foo.com/%zz", Methods: ParseHttpMethods([]string{"GET"})}
+	if invalidItem.Matches("GET", urlMustParse("https://foo.com/")) {
+		t.Error("invalid allowlist item should not match")
+	}
+}
+
+// buildBenchmarkAllowlist builds an allowlist similar in shape to the github, gitlab, and bitbucket presets, repeated across several hosts
+func buildBenchmarkAllowlist() Allowlist {
+	templates := []string{
+		"/repos/:owner/:repo",
+		"/repos/:owner/:repo/pulls",
+		"/repos/:owner/:repo/pulls/:number/comments",
+		"/repos/:owner/:repo/issues/:number/comments",
+		"/orgs/:org/installation",
+		"/orgs/:org/repos",
+		"/users/:user/installation",
+		"/users/:user/installation/repositories",
+		"/app",
+		"/app/installations/:id/access_tokens",
+		"/groups/:namespace/hooks",
+		"/groups/:namespace/hooks/:hook",
+		"/namespaces/:namespace",
+		"/projects/:project",
+		"/projects/:project/hooks",
+		"/projects/:project/hooks/:hook",
+		"/projects/:project/members/all/:user",
+		"/projects/:project/merge_requests",
+		"/projects/:project/merge_requests/:number/versions",
+		"/projects/:project/merge_requests/:number/discussions",
+		"/projects/:project/merge_requests/:number/discussions/:discussion/notes",
+		"/projects/:project/merge_requests/:number/discussions/:discussion/notes/:note",
+		"/projects/:project/repository/files/:filepath",
+		"/projects/:project/repos/:repo/pull-requests/:number/comments",
+	}
+
+	allowlist := Allowlist{}
+	for host := 0; host < 10; host++ {
+		for _, template := range templates {
+			allowlist = append(allowlist, AllowlistItem{
+				URL:     fmt.Sprintf("https://scm%d.example.com/api%s", host, template),
+				Methods: ParseHttpMethods([]string{"GET", "POST"}),
+			})
+		}
+	}
+	return allowlist
+}
+
+func BenchmarkAllowlistFindMatchLinear(b *testing.B) {
+	allowlist := buildBenchmarkAllowlist()
+	target := urlMustParse("https://scm9.example.com/api/projects/platform%2Fapi/repos/web/pull-requests/12/comments")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, match := allowlist.FindMatch("POST", target); !match {
+			b.Fatal("expected match")
+		}
+	}
+}
+
+func BenchmarkAllowlistFindMatchCompiled(b *testing.B) {
+	allowlist := buildBenchmarkAllowlist()
+	target := urlMustParse("https://scm9.example.com/api/projects/platform%2Fapi/repos/web/pull-requests/12/comments")
+
+	compiled, err := allowlist.Compile()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, match := compiled.FindMatch("POST", target); !match {
+			b.Fatal("expected match")
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+)
+
+// auditTailBytes is how much of the end of the log is read to resume the hash chain on startup
+const auditTailBytes = 1 << 20
+
+// AuditRecord is one line of the audit log. Hash covers every other field, including PrevHash, so the records form a chain.
+type AuditRecord struct {
+	Seq            uint64    `json:"seq,omitempty"`
+	Time           time.Time `json:"time"`
+	Decision       string    `json:"decision"`
+	Reason         string    `json:"reason,omitempty"`
+	Method         string    `json:"method"`
+	Destination    string    `json:"destination"`
+	AllowlistMatch string    `json:"allowlistMatch,omitempty"`
+	Status         int       `json:"status"`
+	RequestBytes   int64     `json:"requestBytes"`
+	ResponseBytes  int64     `json:"responseBytes"`
+	LatencyMs      float64   `json:"latencyMs"`
+	PrevHash       string    `json:"prevHash,omitempty"`
+	Hash           string    `json:"hash,omitempty"`
+}
+
+// auditHead is written next to the log after every record, so that truncating the log can be detected.
+// MAC covers the other fields, so that the head can't be rewritten to match a truncated log without the key.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac,omitempty"`
+}
+
+func (head auditHead) computeMAC(key []byte) string {
+	head.MAC = ""
+	data, _ := json.Marshal(head)
+	return hex.EncodeToString(hmacSum(sha256.New, key, string(data)))
+}
+
+// computeHash returns the hash of the record (excluding its own hash), keyed with HMAC if key is set
+func (record AuditRecord) computeHash(key []byte) string {
+	record.Hash = ""
+	data, _ := json.Marshal(record)
+	if len(key) > 0 {
+		return hex.EncodeToString(hmacSum(sha256.New, key, string(data)))
+	}
+	return sha256Hex(data)
+}
+
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// auditFiles returns the log files from oldest to newest
+func auditFiles(path string) []string {
+	var rotated []string
+	for i := 1; ; i++ {
+		rotatedPath := fmt.Sprintf("%v.%d", path, i)
+		if _, err := os.Stat(rotatedPath); err != nil {
+			break
+		}
+		rotated = append([]string{rotatedPath}, rotated...)
+	}
+	return append(rotated, path)
+}
+
+// AuditLog appends hash-chained records to a file, rotating it when it gets too big
+type AuditLog struct {
+	config AuditConfig
+	key    []byte
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	head     *os.File
+	seq      uint64
+	lastHash string
+	closed   bool
+}
+
+// Validate requires an HMAC key, since without one anyone who can write to the log can also rewrite the hash chain
+func (config AuditConfig) Validate() error {
+	if config.Path != "" && config.HMACKey == "" {
+		return fmt.Errorf("audit hmacKey is required when audit path is set")
+	}
+	return nil
+}
+
+func (config AuditConfig) build() (*AuditLog, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	registerLiteralSecret(config.HMACKey)
+	key, err := config.HMACKey.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("audit hmacKey: %v", err)
+	}
+	auditLog := &AuditLog{config: config, key: []byte(key)}
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+
+	// continue the chain from the last record, which may be in a rotated file
+	files := auditFiles(config.Path)
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditRecord(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			auditLog.seq = last.Seq
+			auditLog.lastHash = last.Hash
+			break
+		}
+	}
+
+	if err := auditLog.open(); err != nil {
+		return nil, err
+	}
+	auditLog.head, err = os.OpenFile(auditHeadPath(config.Path), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log head: %v", err)
+	}
+
+	log.WithField("path", config.Path).WithField("seq", auditLog.seq).Info("audit.configured")
+	return auditLog, nil
+}
+
+// lastAuditRecord returns the last complete record in the file, if any
+func lastAuditRecord(path string) (*AuditRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-auditTailBytes, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		record := &AuditRecord{}
+		if json.Unmarshal(lines[i], record) == nil && record.Hash != "" {
+			return record, nil
+		}
+	}
+	return nil, nil
+}
+
+func (auditLog *AuditLog) open() error {
+	file, err := os.OpenFile(auditLog.config.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	auditLog.file = file
+	auditLog.size = info.Size()
+
+	if err := auditLog.trimPartialRecord(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to repair audit log: %v", err)
+	}
+	return nil
+}
+
+// trimPartialRecord removes a partial record from the end of the log (e.g. from a crash while it was being written),
+// so that it doesn't break the hash chain. A record that's only missing its newline is kept.
+func (auditLog *AuditLog) trimPartialRecord() error {
+	if auditLog.size == 0 {
+		return nil
+	}
+	offset := max(auditLog.size-auditTailBytes, 0)
+	tail := make([]byte, auditLog.size-offset)
+	if _, err := auditLog.file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return err
+	}
+	if tail[len(tail)-1] == '\n' {
+		return nil
+	}
+
+	start := bytes.LastIndexByte(tail, '\n') + 1
+	if start == 0 && offset > 0 {
+		return fmt.Errorf("the last record is longer than %d bytes", auditTailBytes)
+	}
+	record := AuditRecord{}
+	if json.Unmarshal(tail[start:], &record) == nil && record.Hash != "" {
+		n, err := auditLog.file.Write([]byte("\n"))
+		auditLog.size += int64(n)
+		return err
+	}
+
+	size := offset + int64(start)
+	if err := auditLog.file.Truncate(size); err != nil {
+		return err
+	}
+	log.WithField("path", auditLog.config.Path).WithField("bytes", auditLog.size-size).Warn("audit.partial_record_removed")
+	auditLog.size = size
+	return nil
+}
+
+// rotate must be called with the lock held
+func (auditLog *AuditLog) rotate() error {
+	auditLog.file.Close()
+	path := auditLog.config.Path
+	os.Remove(fmt.Sprintf("%v.%d", path, auditLog.config.MaxFiles))
+	for i := auditLog.config.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", path, i), fmt.Sprintf("%v.%d", path, i+1))
+	}
+	if auditLog.config.MaxFiles > 0 {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err != nil {
+		return err
+	}
+	return auditLog.open()
+}
+
+// Write appends the record, filling in its sequence number and hashes
+func (auditLog *AuditLog) Write(record *AuditRecord) error {
+	if auditLog == nil {
+		return nil
+	}
+
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.closed {
+		return fmt.Errorf("audit log is closed")
+	}
+
+	record.Seq = auditLog.seq + 1
+	record.PrevHash = auditLog.lastHash
+	record.Hash = record.computeHash(auditLog.key)
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if auditLog.config.MaxBytes > 0 && auditLog.size > 0 && auditLog.size+int64(len(line)) > auditLog.config.MaxBytes {
+		if err := auditLog.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := auditLog.file.Write(line)
+	auditLog.size += int64(n)
+	if err != nil {
+		return err
+	}
+	auditLog.seq = record.Seq
+	auditLog.lastHash = record.Hash
+
+	head := auditHead{Seq: record.Seq, Hash: record.Hash}
+	head.MAC = head.computeMAC(auditLog.key)
+	headData, _ := json.Marshal(head)
+	if err := auditLog.head.Truncate(0); err != nil {
+		return err
+	}
+	_, err = auditLog.head.WriteAt(headData, 0)
+	return err
+}
+
+func (auditLog *AuditLog) Close() error {
+	if auditLog == nil {
+		return nil
+	}
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.closed {
+		return nil
+	}
+	auditLog.closed = true
+
+	auditLog.head.Sync()
+	auditLog.head.Close()
+	auditLog.file.Sync()
+	return auditLog.file.Close()
+}
+
+// countingReadCloser counts the bytes read from a request body
+type countingReadCloser struct {
+	io.ReadCloser
+	count atomic.Int64
+}
+
+func (rc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	rc.count.Add(int64(n))
+	return n, err
+}
+
+// AuditVerifyResult summarizes a verified audit log
+type AuditVerifyResult struct {
+	Files    int
+	Records  int
+	FirstSeq uint64
+	LastSeq  uint64
+	// Rotated is set if the oldest record continues a chain from a file that was rotated away
+	Rotated bool
+}
+
+// VerifyAuditLog checks the hash chain of the audit log and its rotated files, and checks that it hasn't been truncated
+func VerifyAuditLog(path string, key string) (*AuditVerifyResult, error) {
+	result := &AuditVerifyResult{}
+	if key == "" {
+		return result, fmt.Errorf("the audit log's hmacKey is required to verify it")
+	}
+	var prev *AuditRecord
+
+	for _, filePath := range auditFiles(path) {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return result, fmt.Errorf("failed to open %v: %v", filePath, err)
+		}
+		result.Files++
+
+		reader := bufio.NewReader(file)
+		for lineNumber := 1; ; lineNumber++ {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF && len(line) == 0 {
+				break
+			} else if err == io.EOF {
+				file.Close()
+				return result, fmt.Errorf("%v:%d: incomplete record, e.g. from a crash while it was being written (the broker removes it when it restarts)", filePath, lineNumber)
+			} else if err != nil {
+				file.Close()
+				return result, err
+			}
+
+			record := AuditRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				file.Close()
+				return result, fmt.Errorf("%v:%d: invalid record: %v", filePath, lineNumber, err)
+			}
+			if record.computeHash([]byte(key)) != record.Hash {
+				file.Close()
+				return result, fmt.Errorf("%v:%d: record %d has been modified (hash mismatch)", filePath, lineNumber, record.Seq)
+			}
+
+			if prev == nil {
+				result.FirstSeq = record.Seq
+				result.Rotated = record.PrevHash != ""
+			} else if record.Seq != prev.Seq+1 {
+				file.Close()
+				return result, fmt.Errorf("%v:%d: records %d to %d are missing", filePath, lineNumber, prev.Seq+1, record.Seq-1)
+			} else if record.PrevHash != prev.Hash {
+				file.Close()
+				return result, fmt.Errorf("%v:%d: record %d does not follow record %d (chain broken)", filePath, lineNumber, record.Seq, prev.Seq)
+			}
+			prev = &record
+			result.Records++
+			result.LastSeq = record.Seq
+		}
+		file.Close()
+	}
+
+	headData, err := os.ReadFile(auditHeadPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	if len(headData) > 0 {
+		head := auditHead{}
+		if err := json.Unmarshal(headData, &head); err != nil {
+			return result, fmt.Errorf("invalid audit log head: %v", err)
+		}
+		if head.MAC != head.computeMAC([]byte(key)) {
+			return result, fmt.Errorf("audit log head has been modified (mac mismatch)")
+		}
+		if head.Seq > result.LastSeq {
+			return result, fmt.Errorf("audit log has been truncated: the last record is %d but %d records were written", result.LastSeq, head.Seq)
+		}
+		if head.Seq == result.LastSeq && prev != nil && head.Hash != prev.Hash {
+			return result, fmt.Errorf("record %d does not match the audit log head", head.Seq)
+		}
+	}
+
+	return result, nil
+}
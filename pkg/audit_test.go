@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeAuditRecords(t *testing.T, config AuditConfig, count int) {
+	auditLog, err := config.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	for i := 0; i < count; i++ {
+		record := &AuditRecord{Decision: AuditAllowed, Method: "GET", Destination: "https://git.example.com/api/v4/projects/1", Status: 200}
+		if err := auditLog.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertAuditVerifyFails(t *testing.T, path string, key string, expected string) {
+	if _, err := VerifyAuditLog(path, key); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected verification to fail with %q, got %v", expected, err)
+	}
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	config := AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log"), HMACKey: "audit-hmac-key"}
+	writeAuditRecords(t, config, 3)
+	// the chain continues after a restart
+	writeAuditRecords(t, config, 2)
+
+	result, err := VerifyAuditLog(config.Path, "audit-hmac-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Records != 5 || result.FirstSeq != 1 || result.LastSeq != 5 || result.Rotated {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	assertAuditVerifyFails(t, config.Path, "wrong-key", "modified")
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	original := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, AuditConfig{Path: original, HMACKey: "audit-hmac-key"}, 4)
+	data, _ := os.ReadFile(original)
+	head, _ := os.ReadFile(auditHeadPath(original))
+	lines := bytes.SplitAfter(data, []byte("\n"))
+
+	tamper := func(contents []byte) string {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		os.WriteFile(path, contents, 0600)
+		os.WriteFile(auditHeadPath(path), head, 0600)
+		return path
+	}
+
+	modified := bytes.Replace(data, []byte(`"status":200`), []byte(`"status":403`), 1)
+	assertAuditVerifyFails(t, tamper(modified), "audit-hmac-key", "modified")
+
+	removed := bytes.Join([][]byte{lines[0], lines[2], lines[3]}, nil)
+	assertAuditVerifyFails(t, tamper(removed), "audit-hmac-key", "missing")
+
+	truncated := bytes.Join(lines[:3], nil)
+	assertAuditVerifyFails(t, tamper(truncated), "audit-hmac-key", "truncated")
+
+	partial := data[:len(data)-10]
+	assertAuditVerifyFails(t, tamper(partial), "audit-hmac-key", "incomplete")
+
+	// the head can't be rewritten to match the truncated log without the key
+	truncatedPath := tamper(truncated)
+	lastRecord := AuditRecord{}
+	json.Unmarshal(lines[2], &lastRecord)
+	forged := auditHead{Seq: lastRecord.Seq, Hash: lastRecord.Hash}
+	forged.MAC = forged.computeMAC([]byte("wrong-key"))
+	forgedHead, _ := json.Marshal(forged)
+	os.WriteFile(auditHeadPath(truncatedPath), forgedHead, 0600)
+	assertAuditVerifyFails(t, truncatedPath, "audit-hmac-key", "head has been modified")
+
+	assertAuditVerifyFails(t, original, "", "hmacKey is required")
+}
+
+func TestAuditLogPartialRecord(t *testing.T) {
+	config := AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log"), HMACKey: "audit-hmac-key"}
+	writeAuditRecords(t, config, 2)
+	complete, _ := os.ReadFile(config.Path)
+	head, _ := os.ReadFile(auditHeadPath(config.Path))
+
+	// a crash while the third record was being written leaves part of it behind, and the head at the second record
+	writeAuditRecords(t, config, 1)
+	data, _ := os.ReadFile(config.Path)
+	os.WriteFile(config.Path, data[:len(complete)+40], 0600)
+	os.WriteFile(auditHeadPath(config.Path), head, 0600)
+	assertAuditVerifyFails(t, config.Path, "audit-hmac-key", "incomplete")
+
+	// the partial record is removed when the log is opened again, and the chain continues from the second record
+	writeAuditRecords(t, config, 2)
+	result, err := VerifyAuditLog(config.Path, "audit-hmac-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Records != 4 || result.LastSeq != 4 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// a record that's only missing its newline is kept
+	data, _ = os.ReadFile(config.Path)
+	os.WriteFile(config.Path, data[:len(data)-1], 0600)
+	writeAuditRecords(t, config, 1)
+	if result, err := VerifyAuditLog(config.Path, "audit-hmac-key"); err != nil || result.Records != 5 {
+		t.Errorf("expected the complete last record to be kept, got %+v %v", result, err)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	config := AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log"), MaxBytes: 1024, MaxFiles: 2, HMACKey: "audit-hmac-key"}
+	writeAuditRecords(t, config, 20)
+
+	if _, err := os.Stat(config.Path + ".3"); err == nil {
+		t.Error("expected old files to be removed")
+	}
+
+	result, err := VerifyAuditLog(config.Path, "audit-hmac-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 3 || result.LastSeq != 20 || !result.Rotated {
+		t.Errorf("expected the chain to be verified across rotated files, got %+v", result)
+	}
+}
+
+func TestAuditLogRequiresKey(t *testing.T) {
+	config := AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log")}
+	if err := config.Validate(); err == nil {
+		t.Error("expected an audit log without an hmacKey to be rejected")
+	}
+	if _, err := config.build(); err == nil {
+		t.Error("expected an audit log without an hmacKey not to be built")
+	}
+}
+
+func TestAuditLogClose(t *testing.T) {
+	config := AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log"), HMACKey: "audit-hmac-key"}
+	auditLog, err := config.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auditLog.Write(&AuditRecord{Decision: AuditAllowed, Method: "GET", Destination: "https://git.example.com/", Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := auditLog.Write(&AuditRecord{Decision: AuditAllowed, Method: "GET", Destination: "https://git.example.com/", Status: 200}); err == nil {
+		t.Error("expected writes after closing to fail")
+	}
+	if result, err := VerifyAuditLog(config.Path, "audit-hmac-key"); err != nil || result.LastSeq != 1 {
+		t.Errorf("expected the closed log to verify, got %+v %v", result, err)
+	}
+}
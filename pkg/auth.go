@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// requestAuthenticator provides credentials for a proxied request. transport is the one the request will be sent with.
+type requestAuthenticator interface {
+	authHeaders(ctx context.Context, params map[string]string, transport http.RoundTripper) (map[string]string, error)
+}
+
+// refreshableAuthenticator is implemented by authenticators whose credentials can be rejected before they expire
+type refreshableAuthenticator interface {
+	requestAuthenticator
+	// invalidate discards the credentials that were sent as headers, if they're still the current ones
+	invalidate(headers map[string]string)
+}
+
+func (config *AuthConfig) Validate() error {
+	if config == nil {
+		return nil
+	}
+	if (config.Credential == "") == (config.OAuth2 == nil) {
+		return fmt.Errorf("auth must set exactly one of credential or oauth2")
+	}
+	return nil
+}
+
+func (credential CredentialConfig) Validate() error {
+	if credential.Name == "" {
+		return fmt.Errorf("credential name is required")
+	}
+	if credential.OAuth2 == nil {
+		return fmt.Errorf("credential %v: oauth2 is required", credential.Name)
+	}
+	return nil
+}
+
+// buildAuthenticators sets up the authenticator for every allowlist item with an auth block. Items that use the same named credential share its tokens.
+// Token sources of the previous config, if any, are kept when their oauth2 config is unchanged, so that a reload doesn't discard their tokens.
+func (config *InboundProxyConfig) buildAuthenticators(transport http.RoundTripper, previous *InboundProxyConfig) error {
+	previousSources := previous.oauth2TokenSources()
+	var reused []*oauth2TokenSource
+	tokenSource := func(name string, oauth2 *OAuth2Config) *oauth2TokenSource {
+		if source, exists := previousSources[name]; exists && configEqual(reflect.ValueOf(source.config), reflect.ValueOf(oauth2)) {
+			reused = append(reused, source)
+			return source
+		}
+		return newOAuth2TokenSource(name, oauth2, transport)
+	}
+
+	credentials := map[string]requestAuthenticator{}
+	for _, credential := range config.Credentials {
+		if _, exists := credentials[credential.Name]; exists {
+			return fmt.Errorf("duplicate credential name %v", credential.Name)
+		}
+		credentials[credential.Name] = tokenSource(credential.Name, credential.OAuth2)
+	}
+
+	for i := range config.Allowlist {
+		item := &config.Allowlist[i]
+		if item.Auth == nil {
+			continue
+		}
+		if item.Auth.OAuth2 != nil {
+			item.authenticator = tokenSource(item.URL, item.Auth.OAuth2)
+			continue
+		}
+		authenticator, exists := credentials[item.Auth.Credential]
+		if !exists {
+			return fmt.Errorf("allowlist item %d (%v) references unknown credential %v", i, item.URL, item.Auth.Credential)
+		}
+		item.authenticator = authenticator
+	}
+
+	// only switch the kept sources to the new transport once the new config is known to be valid
+	for _, source := range reused {
+		source.setTransport(transport)
+	}
+	return nil
+}
+
+// oauth2TokenSources returns the oauth2 token sources of the allowlist items, by name
+func (config *InboundProxyConfig) oauth2TokenSources() map[string]*oauth2TokenSource {
+	sources := map[string]*oauth2TokenSource{}
+	if config == nil {
+		return sources
+	}
+	for i := range config.Allowlist {
+		if source, ok := config.Allowlist[i].authenticator.(*oauth2TokenSource); ok {
+			sources[source.name] = source
+		}
+	}
+	return sources
+}
+
+// reauthRoundTripper retries a request once with fresh credentials if the destination rejects the ones it was sent with
+type reauthRoundTripper struct {
+	transport     http.RoundTripper
+	authenticator refreshableAuthenticator
+	params        map[string]string
+	headers       map[string]string
+	authTransport http.RoundTripper
+	logger        *log.Entry
+}
+
+// newReauthRoundTripper wraps the transport if the authenticator's credentials can be refreshed. headers are the auth headers the request was sent with.
+func newReauthRoundTripper(transport http.RoundTripper, authenticator requestAuthenticator, params map[string]string, headers map[string]string, authTransport http.RoundTripper, logger *log.Entry) http.RoundTripper {
+	refreshable, ok := authenticator.(refreshableAuthenticator)
+	if !ok {
+		return transport
+	}
+	return &reauthRoundTripper{
+		transport:     transport,
+		authenticator: refreshable,
+		params:        params,
+		headers:       headers,
+		authTransport: authTransport,
+		logger:        logger,
+	}
+}
+
+func (rt *reauthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// even if this request can't be retried, the next one gets new credentials
+	rt.authenticator.invalidate(rt.headers)
+	if !canReplay(req) {
+		return resp, nil
+	}
+
+	headers, err := rt.authenticator.authHeaders(req.Context(), rt.params, rt.authTransport)
+	if err != nil {
+		rt.logger.WithError(err).Warn("proxy.credentials_error")
+		return resp, nil
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryDrainBytes))
+	resp.Body.Close()
+
+	retryReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retryReq.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for headerName, headerValue := range headers {
+		retryReq.Header.Set(headerName, headerValue)
+	}
+
+	rt.logger.Warn("proxy.reauth")
+	return rt.transport.RoundTrip(retryReq)
+}
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"io"
+	"sync"
+)
+
+// bodyCapture passes a body through while keeping its first bytes for logging, so that logged bodies are streamed
+// rather than buffered in full. onDone is called once, when the body has been read to the end or closed.
+type bodyCapture struct {
+	io.ReadCloser
+	// limit is the number of bytes kept, or 0 to keep the whole body
+	limit  int
+	onDone func(captured []byte, totalBytes int64)
+
+	mu         sync.Mutex
+	captured   []byte
+	totalBytes int64
+	done       bool
+}
+
+func newBodyCapture(body io.ReadCloser, limit int, onDone func(captured []byte, totalBytes int64)) *bodyCapture {
+	return &bodyCapture{ReadCloser: body, limit: limit, onDone: onDone}
+}
+
+func (bc *bodyCapture) Read(p []byte) (int, error) {
+	n, err := bc.ReadCloser.Read(p)
+
+	bc.mu.Lock()
+	bc.totalBytes += int64(n)
+	keep := n
+	if bc.limit > 0 {
+		keep = max(min(n, bc.limit-len(bc.captured)), 0)
+	}
+	bc.captured = append(bc.captured, p[:keep]...)
+	bc.mu.Unlock()
+
+	if err == io.EOF {
+		bc.finish()
+	}
+	return n, err
+}
+
+func (bc *bodyCapture) Close() error {
+	err := bc.ReadCloser.Close()
+	bc.finish()
+	return err
+}
+
+// finish calls onDone with what has been read so far, unless it's already been called
+func (bc *bodyCapture) finish() {
+	bc.mu.Lock()
+	if bc.done {
+		bc.mu.Unlock()
+		return
+	}
+	bc.done = true
+	captured, totalBytes := bc.captured, bc.totalBytes
+	bc.mu.Unlock()
+
+	bc.onDone(captured, totalBytes)
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBodyCapture(t *testing.T) {
+	var calls int
+	var captured string
+	var totalBytes int64
+	body := strings.Repeat("a", 10000)
+
+	capture := newBodyCapture(io.NopCloser(strings.NewReader(body)), 100, func(c []byte, total int64) {
+		calls++
+		captured, totalBytes = string(c), total
+	})
+
+	read, err := io.ReadAll(capture)
+	if err != nil || string(read) != body {
+		t.Fatalf("expected the whole body to be passed through, got %d bytes, %v", len(read), err)
+	}
+	capture.Close()
+
+	if calls != 1 || captured != body[:100] || totalBytes != 10000 {
+		t.Errorf("expected one call with the first 100 of 10000 bytes, got %d calls with %d of %d bytes", calls, len(captured), totalBytes)
+	}
+}
+
+func TestBodyCaptureClosedEarly(t *testing.T) {
+	var calls int
+	var captured string
+	capture := newBodyCapture(io.NopCloser(strings.NewReader("hello world")), 0, func(c []byte, total int64) {
+		calls++
+		captured = string(c)
+	})
+
+	buf := make([]byte, 5)
+	capture.Read(buf)
+	capture.Close()
+	capture.finish()
+
+	if calls != 1 || captured != "hello" {
+		t.Errorf("expected one call with the bytes read before closing, got %d calls with %q", calls, captured)
+	}
+}
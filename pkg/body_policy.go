@@ -0,0 +1,290 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/PaesslerAG/jsonpath"
+)
+
+// defaultBodyPolicyMaxBytes limits how much of a request body is buffered so that it can be checked, if maxBytes isn't set
+const defaultBodyPolicyMaxBytes = 1024 * 1024
+
+type BodyPolicyViolation struct {
+	StatusCode int
+	Reason     string
+}
+
+func (v *BodyPolicyViolation) Error() string {
+	return v.Reason
+}
+
+func bodyPolicyViolation(statusCode int, format string, args ...interface{}) *BodyPolicyViolation {
+	return &BodyPolicyViolation{StatusCode: statusCode, Reason: fmt.Sprintf(format, args...)}
+}
+
+type compiledBodyFieldRule struct {
+	BodyFieldRule
+	// path is set when the jsonpath selects a single value, so a missing value can be told apart from an error
+	path     jsonPath
+	evaluate func(context.Context, interface{}) (interface{}, error)
+	pattern  *regexp.Regexp
+}
+
+func (rule BodyFieldRule) compile() (*compiledBodyFieldRule, error) {
+	evaluate, err := jsonpath.New(rule.JSONPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jsonpath %v: %v", rule.JSONPath, err)
+	}
+	pattern, err := compilePattern(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for %v: %v", rule.JSONPath, err)
+	}
+	compiled := &compiledBodyFieldRule{BodyFieldRule: rule, evaluate: evaluate, pattern: pattern}
+	if path, err := parseJSONPath(rule.JSONPath); err == nil && path.definite() {
+		compiled.path = path
+	}
+	return compiled, nil
+}
+
+func (rule BodyFieldRule) Validate() error {
+	_, err := rule.compile()
+	return err
+}
+
+// jsonValueString turns a decoded JSON value into the string that rules are compared against.
+// Strings are compared as-is, everything else is compared using its JSON representation.
+func jsonValueString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// lookup evaluates the rule's jsonpath. found is false if the path selects nothing.
+func (rule *compiledBodyFieldRule) lookup(value map[string]interface{}) (result interface{}, found bool, err error) {
+	if rule.path != nil {
+		result, found = rule.path.lookup(value)
+		return result, found, nil
+	}
+	result, err = rule.evaluate(context.Background(), value)
+	if err != nil {
+		return nil, false, fmt.Errorf("error evaluating jsonpath %v: %v", rule.JSONPath, err)
+	}
+	// wildcards and recursive descent select a list of matches, which is empty if nothing matched
+	if matches, ok := result.([]interface{}); ok && len(matches) == 0 {
+		return nil, false, nil
+	}
+	return result, true, nil
+}
+
+func (rule *compiledBodyFieldRule) Check(value map[string]interface{}) error {
+	result, found, err := rule.lookup(value)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if rule.Required {
+			return fmt.Errorf("%v is required", rule.JSONPath)
+		}
+		return nil
+	}
+
+	resultStr := jsonValueString(result)
+
+	if len(rule.Equals) > 0 && !stringInSlice(resultStr, rule.Equals) {
+		return fmt.Errorf("%v is not an allowed value", rule.JSONPath)
+	}
+
+	if len(rule.HasPrefix) > 0 {
+		hasPrefix := false
+		for _, prefix := range rule.HasPrefix {
+			if strings.HasPrefix(resultStr, prefix) {
+				hasPrefix = true
+				break
+			}
+		}
+		if !hasPrefix {
+			return fmt.Errorf("%v does not have an allowed prefix", rule.JSONPath)
+		}
+	}
+
+	if rule.pattern != nil && !rule.pattern.MatchString(resultStr) {
+		return fmt.Errorf("%v does not match pattern", rule.JSONPath)
+	}
+
+	return nil
+}
+
+func stringInSlice(needle string, haystack []string) bool {
+	for i := range haystack {
+		if haystack[i] == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func contentTypeAllowed(mediaType string, allowed []string) bool {
+	for i := range allowed {
+		if strings.EqualFold(mediaType, allowed[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *BodyPolicy) needsJSON() bool {
+	return len(policy.AllowedFields) > 0 || len(policy.RequiredFields) > 0 || len(policy.Rules) > 0
+}
+
+// duplicateKey returns the first object key that appears twice in the same object. Upstreams disagree on which of
+// the values wins, so a body with duplicate keys can't be checked reliably. Invalid JSON is left to the caller.
+func duplicateKey(body []byte) (string, bool) {
+	type frame struct {
+		keys      map[string]bool
+		expectKey bool
+	}
+	var stack []*frame
+	valueDone := func() {
+		if len(stack) > 0 && stack[len(stack)-1].keys != nil {
+			stack[len(stack)-1].expectKey = true
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+		if len(stack) > 0 && stack[len(stack)-1].expectKey {
+			if key, ok := token.(string); ok {
+				top := stack[len(stack)-1]
+				if top.keys[key] {
+					return key, true
+				}
+				top.keys[key] = true
+				top.expectKey = false
+				continue
+			}
+		}
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &frame{keys: map[string]bool{}, expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, &frame{})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
+
+type compiledBodyPolicy struct {
+	*BodyPolicy
+	rules []*compiledBodyFieldRule
+}
+
+// compile compiles the policy's rules. A nil policy compiles to nil.
+func (policy *BodyPolicy) compile() (*compiledBodyPolicy, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	compiled := &compiledBodyPolicy{BodyPolicy: policy}
+	for i := range policy.Rules {
+		rule, err := policy.Rules[i].compile()
+		if err != nil {
+			return nil, err
+		}
+		compiled.rules = append(compiled.rules, rule)
+	}
+	return compiled, nil
+}
+
+func (policy *BodyPolicy) maxBytes() int64 {
+	if policy.MaxBytes == 0 {
+		return defaultBodyPolicyMaxBytes
+	}
+	return policy.MaxBytes
+}
+
+// Check verifies that a request body satisfies the policy
+func (policy *compiledBodyPolicy) Check(header http.Header, body []byte) error {
+	if int64(len(body)) > policy.maxBytes() {
+		return bodyPolicyViolation(http.StatusRequestEntityTooLarge, "request body is larger than %v bytes", policy.maxBytes())
+	}
+
+	if len(policy.ContentTypes) > 0 && len(body) > 0 {
+		mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil || !contentTypeAllowed(mediaType, policy.ContentTypes) {
+			return bodyPolicyViolation(http.StatusUnsupportedMediaType, "content type %q is not allowed", header.Get("Content-Type"))
+		}
+	}
+
+	if !policy.needsJSON() {
+		return nil
+	}
+
+	value := make(map[string]interface{})
+	if len(bytes.TrimSpace(body)) > 0 {
+		if key, duplicate := duplicateKey(body); duplicate {
+			return bodyPolicyViolation(http.StatusForbidden, "field %v appears more than once in request body", key)
+		}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return bodyPolicyViolation(http.StatusForbidden, "request body is not a JSON object")
+		}
+	}
+
+	if len(policy.AllowedFields) > 0 {
+		for field := range value {
+			if !stringInSlice(field, policy.AllowedFields) {
+				return bodyPolicyViolation(http.StatusForbidden, "field %v is not allowed in request body", field)
+			}
+		}
+	}
+
+	for _, field := range policy.RequiredFields {
+		if _, exists := value[field]; !exists {
+			return bodyPolicyViolation(http.StatusForbidden, "field %v is required in request body", field)
+		}
+	}
+
+	for _, rule := range policy.rules {
+		if err := rule.Check(value); err != nil {
+			return bodyPolicyViolation(http.StatusForbidden, "%v", err)
+		}
+	}
+
+	return nil
+}
+
+// ReadAndCheck reads the request body (up to the size limit), checks it against the policy, and replaces the body so it can be proxied
+func (policy *compiledBodyPolicy) ReadAndCheck(req *http.Request) error {
+	if req.ContentLength > policy.maxBytes() {
+		return bodyPolicyViolation(http.StatusRequestEntityTooLarge, "request body is larger than %v bytes", policy.maxBytes())
+	}
+
+	// read one extra byte so oversized bodies can be detected
+	body, err := io.ReadAll(io.LimitReader(req.Body, policy.maxBytes()+1))
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %v", err)
+	}
+	replaceBody(req, body)
+
+	return policy.Check(req.Header, body)
+}
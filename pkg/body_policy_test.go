@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func assertBodyPolicyStatus(t *testing.T, policy *BodyPolicy, contentType string, body string, expectedStatusCode int) {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	compiled, err := policy.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compiled.Check(header, []byte(body))
+	statusCode := http.StatusOK
+	if err != nil {
+		violation, ok := err.(*BodyPolicyViolation)
+		if !ok {
+			t.Fatalf("unexpected error type: %v", err)
+		}
+		statusCode = violation.StatusCode
+	}
+
+	if statusCode != expectedStatusCode {
+		t.Errorf("%v body %v resulted in HTTP %v, expected HTTP %v (%v)", contentType, body, statusCode, expectedStatusCode, err)
+	}
+}
+
+func TestBodyPolicyContentTypeAndSize(t *testing.T) {
+	policy := &BodyPolicy{
+		ContentTypes: []string{"application/json"},
+		MaxBytes:     16,
+	}
+
+	assertBodyPolicyStatus(t, policy, "application/json", `{"a": 1}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "Application/JSON; charset=utf-8", `{"a": 1}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "text/plain", `{"a": 1}`, http.StatusUnsupportedMediaType)
+	assertBodyPolicyStatus(t, policy, "", `{"a": 1}`, http.StatusUnsupportedMediaType)
+	assertBodyPolicyStatus(t, policy, "", "", http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"a": "0123456789"}`, http.StatusRequestEntityTooLarge)
+}
+
+func TestBodyPolicyDefaultMaxBytes(t *testing.T) {
+	compiled, err := (&BodyPolicy{ContentTypes: []string{"application/octet-stream"}}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readAndCheck := func(contentLength int64) (*countingReadCloser, error) {
+		body := &countingReadCloser{ReadCloser: io.NopCloser(io.LimitReader(zeroReader{}, 10*defaultBodyPolicyMaxBytes))}
+		req, _ := http.NewRequest("POST", "https://git.example.com/upload", body)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = contentLength
+		return body, compiled.ReadAndCheck(req)
+	}
+
+	// a chunked body is only read up to the limit
+	body, err := readAndCheck(-1)
+	if violation, ok := err.(*BodyPolicyViolation); !ok || violation.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected HTTP 413, got %v", err)
+	}
+	if body.count.Load() > defaultBodyPolicyMaxBytes+1 {
+		t.Errorf("expected at most %d bytes to be read, got %d", defaultBodyPolicyMaxBytes+1, body.count.Load())
+	}
+
+	// a body with a Content-Length over the limit isn't read at all
+	body, err = readAndCheck(10 * defaultBodyPolicyMaxBytes)
+	if violation, ok := err.(*BodyPolicyViolation); !ok || violation.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected HTTP 413, got %v", err)
+	}
+	if body.count.Load() != 0 {
+		t.Errorf("expected the body not to be read, got %d bytes", body.count.Load())
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestBodyPolicyFields(t *testing.T) {
+	policy := &BodyPolicy{
+		AllowedFields:  []string{"body", "commit_id", "path", "line"},
+		RequiredFields: []string{"body"},
+	}
+
+	assertBodyPolicyStatus(t, policy, "application/json", `{"body": "hi"}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"body": "hi", "commit_id": "abc", "path": "a.go", "line": 3}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"body": "hi", "url": "https://evil.example.com"}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"path": "a.go"}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `["body"]`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", ``, http.StatusForbidden)
+}
+
+func TestBodyPolicyRules(t *testing.T) {
+	policy := &BodyPolicy{
+		Rules: []BodyFieldRule{
+			{JSONPath: "$.url", Required: true, HasPrefix: []string{"https://semgrep.dev/"}},
+			{JSONPath: "$.push_events", Equals: []string{"false"}},
+			{JSONPath: "$.token", Pattern: "[a-f0-9]{8}"},
+		},
+	}
+
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/api/webhook"}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://evil.example.com/"}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "push_events": false}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "push_events": true}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "token": "deadbeef"}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "token": "deadbeef0"}`, http.StatusForbidden)
+}
+
+func TestBodyPolicyMissingValues(t *testing.T) {
+	policy := &BodyPolicy{
+		Rules: []BodyFieldRule{
+			{JSONPath: "$.head.ref", Equals: []string{"main"}},
+			{JSONPath: "$.labels[1]", Equals: []string{"security"}},
+			{JSONPath: "$.reviewers[*].login", HasPrefix: []string{"semgrep"}},
+		},
+	}
+
+	assertBodyPolicyStatus(t, policy, "application/json", `{}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"head": {}, "labels": ["bug"], "reviewers": []}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"head": "main"}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"head": {"ref": "main"}, "labels": ["bug", "security"]}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"head": {"ref": "dev"}}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"labels": ["bug", "wontfix"]}`, http.StatusForbidden)
+
+	required := &BodyPolicy{Rules: []BodyFieldRule{{JSONPath: "$.head.ref", Required: true}}}
+	assertBodyPolicyStatus(t, required, "application/json", `{"head": {"sha": "abc"}}`, http.StatusForbidden)
+}
+
+func TestBodyPolicyDuplicateKeys(t *testing.T) {
+	policy := &BodyPolicy{
+		Rules: []BodyFieldRule{{JSONPath: "$.url", HasPrefix: []string{"https://semgrep.dev/"}}},
+	}
+
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "config": {"url": "x"}}`, http.StatusOK)
+	assertBodyPolicyStatus(t, policy, "application/json", `[{"url": "a"}, {"url": "b"}]`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "url": "https://evil.example.com/"}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "config": {"a": 1, "a": 2}}`, http.StatusForbidden)
+	assertBodyPolicyStatus(t, policy, "application/json", `{"url": "https://semgrep.dev/", "list": [{"a": 1}, {"a": 2}]}`, http.StatusOK)
+}
+
+func TestBodyFieldRuleValidate(t *testing.T) {
+	if err := (BodyFieldRule{JSONPath: "$.token", Pattern: "[a-f"}).Validate(); err == nil {
+		t.Errorf("expected an invalid pattern to be rejected")
+	}
+	if err := (BodyFieldRule{JSONPath: "$.[", Pattern: "[a-f]+"}).Validate(); err == nil {
+		t.Errorf("expected an invalid jsonpath to be rejected")
+	}
+}
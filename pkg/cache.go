@@ -0,0 +1,509 @@
+package pkg
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const cacheResponseHeader = "X-Semgrep-Private-Link-Cache"
+
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheRevalidated = "revalidated"
+	cacheBypass      = "bypass"
+)
+
+// cacheKeyHeaders are request headers that always change the response, in addition to the allowlist item's SetRequestHeaders
+var cacheKeyHeaders = []string{"Authorization", "Accept", "Accept-Encoding"}
+
+// lruCache is a least recently used cache bounded by entry count and total size
+type lruCache struct {
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	ll         *list.List
+	items      map[string]*list.Element
+	onEvict    func(key string)
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	value interface{}
+}
+
+func newLruCache(maxEntries int, maxBytes int64, onEvict func(key string)) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+		onEvict:    onEvict,
+	}
+}
+
+func (lru *lruCache) get(key string) (interface{}, bool) {
+	element, exists := lru.items[key]
+	if !exists {
+		return nil, false
+	}
+	lru.ll.MoveToFront(element)
+	return element.Value.(*lruItem).value, true
+}
+
+func (lru *lruCache) add(key string, value interface{}, size int64) {
+	if element, exists := lru.items[key]; exists {
+		item := element.Value.(*lruItem)
+		lru.bytes += size - item.size
+		item.value = value
+		item.size = size
+		lru.ll.MoveToFront(element)
+	} else {
+		lru.items[key] = lru.ll.PushFront(&lruItem{key: key, size: size, value: value})
+		lru.bytes += size
+	}
+
+	for lru.ll.Len() > 0 && ((lru.maxEntries > 0 && lru.ll.Len() > lru.maxEntries) || (lru.maxBytes > 0 && lru.bytes > lru.maxBytes)) {
+		lru.removeElement(lru.ll.Back())
+	}
+}
+
+func (lru *lruCache) remove(key string) {
+	if element, exists := lru.items[key]; exists {
+		lru.removeElement(element)
+	}
+}
+
+func (lru *lruCache) removeElement(element *list.Element) {
+	item := element.Value.(*lruItem)
+	lru.ll.Remove(element)
+	delete(lru.items, item.key)
+	lru.bytes -= item.size
+	if lru.onEvict != nil {
+		lru.onEvict(item.key)
+	}
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	StoredAt   time.Time   `json:"storedAt"`
+	// request header values for the headers listed in the response's Vary header
+	VaryValues http.Header `json:"varyValues"`
+}
+
+func (entry *cacheEntry) size() int64 {
+	size := int64(len(entry.Body))
+	for name, values := range entry.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// cacheControl parses a Cache-Control header into directives, e.g. {"max-age": "60", "private": ""}
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// freshFor returns how long the response can be served without revalidating it
+func (entry *cacheEntry) freshFor() time.Duration {
+	directives := cacheControl(entry.Header)
+	if _, noCache := directives["no-cache"]; noCache {
+		return 0
+	}
+	maxAge, exists := directives["s-maxage"]
+	if !exists {
+		maxAge = directives["max-age"]
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil {
+		return 0
+	}
+	if age, err := strconv.Atoi(entry.Header.Get("Age")); err == nil {
+		seconds -= age
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (entry *cacheEntry) isFresh(now time.Time) bool {
+	return now.Sub(entry.StoredAt) < entry.freshFor()
+}
+
+func (entry *cacheEntry) hasValidator() bool {
+	return entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != ""
+}
+
+func (entry *cacheEntry) matchesVary(req *http.Request) bool {
+	for name := range entry.VaryValues {
+		if strings.Join(req.Header.Values(name), ",") != entry.VaryValues.Get(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (entry *cacheEntry) response(req *http.Request, result string) *http.Response {
+	header := entry.Header.Clone()
+	header.Set(cacheResponseHeader, result)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}
+}
+
+// isCacheable checks whether a response can be stored
+func isCacheable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	directives := cacheControl(resp.Header)
+	if _, noStore := directives["no-store"]; noStore {
+		return false
+	}
+	// the broker is a shared cache, so it doesn't store responses meant for a single user
+	if _, private := directives["private"]; private {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	entry := &cacheEntry{Header: resp.Header}
+	// a response that's never fresh and can't be revalidated is useless to store
+	return entry.freshFor() > 0 || entry.hasValidator()
+}
+
+// ResponseCache stores GET responses in memory, and optionally on disk. Files are read and written without holding
+// the lock, so that disk I/O for one response doesn't hold up the others.
+type ResponseCache struct {
+	config ResponseCacheConfig
+	mu     sync.Mutex
+	memory *lruCache
+	disk   *lruCache
+	// evicted are the keys whose files have to be removed once the lock is released
+	evicted []string
+}
+
+func (config ResponseCacheConfig) build() (*ResponseCache, error) {
+	cache := &ResponseCache{
+		config: config,
+		memory: newLruCache(config.MaxEntries, config.MaxBytes, nil),
+	}
+
+	if config.Directory != "" {
+		if err := os.MkdirAll(config.Directory, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %v", err)
+		}
+		cache.disk = newLruCache(0, config.MaxDiskBytes, func(key string) {
+			cache.evicted = append(cache.evicted, key)
+		})
+		if err := cache.loadDiskIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cache, nil
+}
+
+func (cache *ResponseCache) diskPath(key string) string {
+	return filepath.Join(cache.config.Directory, key+".json")
+}
+
+// loadDiskIndex adds the entries already on disk to the disk LRU, oldest first
+func (cache *ResponseCache) loadDiskIndex() error {
+	files, err := os.ReadDir(cache.config.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	type diskFile struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	diskFiles := make([]diskFile, 0, len(files))
+	for _, file := range files {
+		// temporary files are left behind if the broker stopped while it was writing them
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			os.Remove(filepath.Join(cache.config.Directory, file.Name()))
+			continue
+		}
+		key, isEntry := strings.CutSuffix(file.Name(), ".json")
+		if !isEntry || file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		diskFiles = append(diskFiles, diskFile{key: key, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(diskFiles, func(i, j int) bool { return diskFiles[i].modTime.Before(diskFiles[j].modTime) })
+
+	for _, file := range diskFiles {
+		cache.disk.add(file.key, nil, file.size)
+	}
+	cache.removeEvicted()
+	return nil
+}
+
+// removeEvicted removes the files of entries that were evicted from the disk LRU. It must be called without the lock held.
+func (cache *ResponseCache) removeEvicted() {
+	cache.mu.Lock()
+	evicted := cache.evicted
+	cache.evicted = nil
+	cache.mu.Unlock()
+
+	for _, key := range evicted {
+		os.Remove(cache.diskPath(key))
+	}
+}
+
+func (cache *ResponseCache) get(key string) (*cacheEntry, bool) {
+	cache.mu.Lock()
+	if value, exists := cache.memory.get(key); exists {
+		cache.mu.Unlock()
+		return value.(*cacheEntry), true
+	}
+	onDisk := false
+	if cache.disk != nil {
+		_, onDisk = cache.disk.get(key)
+	}
+	cache.mu.Unlock()
+	if !onDisk {
+		return nil, false
+	}
+
+	contents, err := os.ReadFile(cache.diskPath(key))
+	entry := &cacheEntry{}
+	if err == nil {
+		err = json.Unmarshal(contents, entry)
+	}
+
+	cache.mu.Lock()
+	if err != nil {
+		log.WithError(err).Warn("cache.disk_read")
+		cache.disk.remove(key)
+	} else {
+		cache.memory.add(key, entry, entry.size())
+	}
+	cache.mu.Unlock()
+	cache.removeEvicted()
+	return entry, err == nil
+}
+
+func (cache *ResponseCache) put(key string, entry *cacheEntry) {
+	cache.mu.Lock()
+	cache.memory.add(key, entry, entry.size())
+	cache.mu.Unlock()
+	if cache.disk == nil {
+		return
+	}
+
+	contents, err := json.Marshal(entry)
+	if err == nil {
+		err = cache.writeFile(key, contents)
+	}
+	if err != nil {
+		log.WithError(err).Warn("cache.disk_write")
+		return
+	}
+
+	cache.mu.Lock()
+	cache.disk.add(key, nil, int64(len(contents)))
+	cache.mu.Unlock()
+	cache.removeEvicted()
+}
+
+// writeFile writes the entry to a temporary file first, so that a concurrent get never reads a partial entry
+func (cache *ResponseCache) writeFile(key string, contents []byte) error {
+	file, err := os.CreateTemp(cache.config.Directory, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), cache.diskPath(key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// key identifies a response by URL and every request header that could change it, including injected credentials.
+// It's hashed so credentials aren't kept in memory or written to disk in the clear.
+func cacheKey(req *http.Request, keyHeaders []string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", req.Method, req.URL.String())
+	for _, name := range keyHeaders {
+		fmt.Fprintf(hash, "%s: %q\n", http.CanonicalHeaderKey(name), req.Header.Values(name))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+type cachingRoundTripper struct {
+	cache      *ResponseCache
+	transport  http.RoundTripper
+	keyHeaders []string
+}
+
+// wrap adds the cache to the transport for an allowlist item, if the item has caching enabled
+func (cache *ResponseCache) wrap(transport http.RoundTripper, item *AllowlistItem) http.RoundTripper {
+	if cache == nil || !item.Cache {
+		return transport
+	}
+
+	keyHeaders := append([]string{}, cacheKeyHeaders...)
+	for name := range item.SetRequestHeaders {
+		keyHeaders = append(keyHeaders, name)
+	}
+	sort.Strings(keyHeaders)
+
+	return &cachingRoundTripper{cache: cache, transport: transport, keyHeaders: keyHeaders}
+}
+
+func (rt *cachingRoundTripper) bypass(req *http.Request) (*http.Response, error) {
+	cacheRequestsCounter.WithLabelValues(cacheBypass).Inc()
+	return rt.transport.RoundTrip(req)
+}
+
+func (rt *cachingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// conditional requests from the client are passed through so it gets the 304s it expects
+	if req.Method != http.MethodGet || req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return rt.bypass(req)
+	}
+	requestDirectives := cacheControl(req.Header)
+	if _, noStore := requestDirectives["no-store"]; noStore {
+		return rt.bypass(req)
+	}
+	_, noCache := requestDirectives["no-cache"]
+
+	key := cacheKey(req, rt.keyHeaders)
+	entry, exists := rt.cache.get(key)
+	if exists && !entry.matchesVary(req) {
+		exists = false
+	}
+
+	if exists && !noCache && entry.isFresh(time.Now()) {
+		cacheRequestsCounter.WithLabelValues(cacheHit).Inc()
+		return entry.response(req, cacheHit), nil
+	}
+
+	upstreamReq := req
+	if exists && entry.hasValidator() {
+		upstreamReq = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			upstreamReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			upstreamReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := rt.transport.RoundTrip(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		// update the stored response with the new freshness information
+		updated := *entry
+		updated.Header = entry.Header.Clone()
+		for _, name := range []string{"Cache-Control", "Date", "Expires", "ETag", "Last-Modified", "Age"} {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				updated.Header[name] = values
+			} else if name == "Age" {
+				updated.Header.Del(name)
+			}
+		}
+		updated.StoredAt = time.Now()
+		rt.cache.put(key, &updated)
+		cacheRequestsCounter.WithLabelValues(cacheRevalidated).Inc()
+		return updated.response(req, cacheRevalidated), nil
+	}
+
+	cacheRequestsCounter.WithLabelValues(cacheMiss).Inc()
+	resp.Header.Set(cacheResponseHeader, cacheMiss)
+	if !isCacheable(resp) {
+		return resp, nil
+	}
+
+	// buffer the body, unless it's too large to store
+	limit := rt.cache.config.MaxEntryBytes
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	varyValues := http.Header{}
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				varyValues.Set(name, strings.Join(req.Header.Values(name), ","))
+			}
+		}
+	}
+
+	header := resp.Header.Clone()
+	header.Del(cacheResponseHeader)
+	rt.cache.put(key, &cacheEntry{
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Body:       body,
+		StoredAt:   time.Now(),
+		VaryValues: varyValues,
+	})
+
+	return resp, nil
+}
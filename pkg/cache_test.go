@@ -0,0 +1,204 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// etagServer serves a body with an ETag and the given Cache-Control, answering conditional requests with 304s
+func etagServer(cacheControl string) (*httptest.Server, *int64, *int64) {
+	var requests, notModified int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("token=" + r.Header.Get("Authorization")))
+	}))
+	return server, &requests, &notModified
+}
+
+func testCacheConfig() ResponseCacheConfig {
+	return ResponseCacheConfig{MaxEntries: 10, MaxBytes: 1 << 20, MaxEntryBytes: 1 << 10, MaxDiskBytes: 1 << 20}
+}
+
+func doCachedRequest(t *testing.T, transport http.RoundTripper, target string, token string) (string, string) {
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Header.Set("Authorization", token)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body), resp.Header.Get(cacheResponseHeader)
+}
+
+func TestResponseCacheFresh(t *testing.T) {
+	server, requests, _ := etagServer("max-age=60")
+	defer server.Close()
+
+	cache, err := testCacheConfig().build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := cache.wrap(http.DefaultTransport, &AllowlistItem{Cache: true})
+
+	if body, result := doCachedRequest(t, transport, server.URL, "a"); body != "token=a" || result != cacheMiss {
+		t.Errorf("unexpected first response: %v (%v)", body, result)
+	}
+	if body, result := doCachedRequest(t, transport, server.URL, "a"); body != "token=a" || result != cacheHit {
+		t.Errorf("unexpected cached response: %v (%v)", body, result)
+	}
+	// different credentials never share a response
+	if body, result := doCachedRequest(t, transport, server.URL, "b"); body != "token=b" || result != cacheMiss {
+		t.Errorf("unexpected response for other credentials: %v (%v)", body, result)
+	}
+	if *requests != 2 {
+		t.Errorf("expected 2 upstream requests, got %v", *requests)
+	}
+}
+
+func TestResponseCachePrivate(t *testing.T) {
+	server, requests, _ := etagServer("private, max-age=60")
+	defer server.Close()
+
+	cache, _ := testCacheConfig().build()
+	transport := cache.wrap(http.DefaultTransport, &AllowlistItem{Cache: true})
+
+	doCachedRequest(t, transport, server.URL, "a")
+	if body, result := doCachedRequest(t, transport, server.URL, "a"); body != "token=a" || result != cacheMiss {
+		t.Errorf("expected private responses not to be cached: %v (%v)", body, result)
+	}
+	if *requests != 2 {
+		t.Errorf("expected 2 upstream requests, got %v", *requests)
+	}
+}
+
+func TestResponseCacheRevalidation(t *testing.T) {
+	server, requests, notModified := etagServer("no-cache")
+	defer server.Close()
+
+	cache, _ := testCacheConfig().build()
+	transport := cache.wrap(http.DefaultTransport, &AllowlistItem{Cache: true})
+
+	doCachedRequest(t, transport, server.URL, "a")
+	if body, result := doCachedRequest(t, transport, server.URL, "a"); body != "token=a" || result != cacheRevalidated {
+		t.Errorf("unexpected revalidated response: %v (%v)", body, result)
+	}
+	if *requests != 2 || *notModified != 1 {
+		t.Errorf("expected a conditional request upstream, got %v requests and %v 304s", *requests, *notModified)
+	}
+}
+
+func TestResponseCacheSetRequestHeadersKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.Header.Get("Private-Token")))
+	}))
+	defer server.Close()
+
+	cache, _ := testCacheConfig().build()
+	item := &AllowlistItem{Cache: true, SetRequestHeaders: map[string]SecretString{"Private-Token": ""}}
+	transport := cache.wrap(http.DefaultTransport, item)
+
+	for _, token := range []string{"one", "two"} {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Private-Token", token)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != token {
+			t.Errorf("expected the response for %v, got %v", token, string(body))
+		}
+	}
+}
+
+func TestResponseCacheDisk(t *testing.T) {
+	server, requests, _ := etagServer("max-age=60")
+	defer server.Close()
+
+	config := testCacheConfig()
+	config.Directory = t.TempDir()
+
+	cache, _ := config.build()
+	doCachedRequest(t, cache.wrap(http.DefaultTransport, &AllowlistItem{Cache: true}), server.URL, "a")
+
+	// a new cache (e.g. after a restart) reads the entry back from disk
+	cache, err := config.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, result := doCachedRequest(t, cache.wrap(http.DefaultTransport, &AllowlistItem{Cache: true}), server.URL, "a"); body != "token=a" || result != cacheHit {
+		t.Errorf("unexpected response from disk: %v (%v)", body, result)
+	}
+	if *requests != 1 {
+		t.Errorf("expected 1 upstream request, got %v", *requests)
+	}
+}
+
+func TestResponseCacheDiskConcurrent(t *testing.T) {
+	config := testCacheConfig()
+	config.Directory = t.TempDir()
+	config.MaxEntries = 2
+	config.MaxDiskBytes = 1 << 10
+	cache, err := config.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprint((i + j) % 10)
+				if entry, exists := cache.get(key); exists && string(entry.Body) != key {
+					t.Errorf("expected entry %v, got %v", key, string(entry.Body))
+				}
+				cache.put(key, &cacheEntry{StatusCode: http.StatusOK, Header: http.Header{}, Body: []byte(key)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	files, _ := os.ReadDir(config.Directory)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			t.Errorf("expected no temporary files to be left behind, got %v", file.Name())
+		}
+	}
+}
+
+func TestLruCacheEviction(t *testing.T) {
+	var evicted []string
+	lru := newLruCache(2, 10, func(key string) { evicted = append(evicted, key) })
+
+	lru.add("a", 1, 4)
+	lru.add("b", 2, 4)
+	lru.get("a")
+	lru.add("c", 3, 4)
+	if _, exists := lru.get("b"); exists {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+
+	lru.add("d", 4, 8)
+	if len(evicted) != 3 || lru.bytes != 8 {
+		t.Errorf("expected entries to be evicted to stay under the size limit, evicted %v, %v bytes", evicted, lru.bytes)
+	}
+}
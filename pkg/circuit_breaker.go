@@ -0,0 +1,228 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (state circuitState) String() string {
+	switch state {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+type circuitOutcome int
+
+const (
+	circuitSuccess circuitOutcome = iota
+	circuitFailure
+	// the request was abandoned by the client, so it says nothing about the destination
+	circuitCanceled
+)
+
+// CircuitOpenError is returned without contacting the destination while its circuit breaker is open
+type CircuitOpenError struct {
+	Host string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %v is open", e.Host)
+}
+
+func (config *CircuitBreakerConfig) enabled() bool {
+	return config.FailureThreshold > 0
+}
+
+func (config *CircuitBreakerConfig) isFailureStatus(statusCode int) bool {
+	if len(config.StatusCodes) == 0 {
+		return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+	}
+	for _, failureStatusCode := range config.StatusCodes {
+		if statusCode == failureStatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+type circuitBreaker struct {
+	host   string
+	config *CircuitBreakerConfig
+
+	mu                sync.Mutex
+	state             circuitState
+	failures          int
+	openedAt          time.Time
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+}
+
+// setState must be called with the lock held
+func (cb *circuitBreaker) setState(state circuitState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+	cb.state = state
+	cb.failures = 0
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+	if state == circuitOpen {
+		cb.openedAt = now
+	}
+	circuitBreakerStateGauge.WithLabelValues(cb.host).Set(float64(state))
+	log.WithField("host", cb.host).WithField("state", state.String()).Warn("circuit_breaker.state")
+}
+
+// allow checks whether a request may be sent. If so, the returned function must be called with the outcome.
+func (cb *circuitBreaker) allow(now time.Time) (func(circuitOutcome, time.Time), error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitOpen && now.Sub(cb.openedAt) >= time.Duration(cb.config.CooldownSeconds)*time.Second {
+		cb.setState(circuitHalfOpen, now)
+	}
+
+	switch cb.state {
+	case circuitOpen:
+		return nil, &CircuitOpenError{Host: cb.host}
+	case circuitHalfOpen:
+		if cb.halfOpenInFlight >= cb.config.HalfOpenRequests {
+			return nil, &CircuitOpenError{Host: cb.host}
+		}
+		cb.halfOpenInFlight++
+	}
+
+	admittedIn := cb.state
+	return func(outcome circuitOutcome, now time.Time) {
+		cb.record(admittedIn, outcome, now)
+	}, nil
+}
+
+func (cb *circuitBreaker) record(admittedIn circuitState, outcome circuitOutcome, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	// ignore requests that started before the last state change
+	if cb.state != admittedIn {
+		return
+	}
+
+	switch cb.state {
+	case circuitClosed:
+		switch outcome {
+		case circuitSuccess:
+			cb.failures = 0
+		case circuitFailure:
+			cb.failures++
+			if cb.failures >= cb.config.FailureThreshold {
+				cb.setState(circuitOpen, now)
+			}
+		}
+	case circuitHalfOpen:
+		cb.halfOpenInFlight--
+		switch outcome {
+		case circuitSuccess:
+			cb.halfOpenSuccesses++
+			if cb.halfOpenSuccesses >= cb.config.HalfOpenRequests {
+				cb.setState(circuitClosed, now)
+			}
+		case circuitFailure:
+			cb.setState(circuitOpen, now)
+		}
+	}
+}
+
+func (cb *circuitBreaker) currentState() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// circuitBreakers holds a circuit breaker for each destination host
+type circuitBreakers struct {
+	config   CircuitBreakerConfig
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func (config CircuitBreakerConfig) build() *circuitBreakers {
+	if !config.enabled() {
+		return nil
+	}
+	return &circuitBreakers{config: config, breakers: map[string]*circuitBreaker{}}
+}
+
+func (breakers *circuitBreakers) get(host string) *circuitBreaker {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+
+	breaker, exists := breakers.breakers[host]
+	if !exists {
+		// hosts are limited to the ones in the allowlist, so this map stays small
+		breaker = &circuitBreaker{host: host, config: &breakers.config}
+		breakers.breakers[host] = breaker
+		circuitBreakerStateGauge.WithLabelValues(host).Set(float64(circuitClosed))
+	}
+	return breaker
+}
+
+// states returns the state of each host's circuit breaker, for the healthcheck
+func (breakers *circuitBreakers) states() map[string]string {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+
+	states := make(map[string]string, len(breakers.breakers))
+	for host, breaker := range breakers.breakers {
+		states[host] = breaker.currentState().String()
+	}
+	return states
+}
+
+type circuitBreakerRoundTripper struct {
+	transport http.RoundTripper
+	breakers  *circuitBreakers
+}
+
+// wrap adds the circuit breakers to the transport, if they're enabled
+func (breakers *circuitBreakers) wrap(transport http.RoundTripper) http.RoundTripper {
+	if breakers == nil {
+		return transport
+	}
+	return &circuitBreakerRoundTripper{transport: transport, breakers: breakers}
+}
+
+func (rt *circuitBreakerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := rt.breakers.get(req.URL.Host)
+	done, err := breaker.allow(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.transport.RoundTrip(req)
+
+	outcome := circuitSuccess
+	if req.Context().Err() != nil {
+		outcome = circuitCanceled
+	} else if err != nil || rt.breakers.config.isFailureStatus(resp.StatusCode) {
+		outcome = circuitFailure
+	}
+	done(outcome, time.Now())
+
+	return resp, err
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func assertCircuitState(t *testing.T, breaker *circuitBreaker, expected circuitState) {
+	if state := breaker.currentState(); state != expected {
+		t.Errorf("expected circuit to be %v, got %v", expected, state)
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	breakers := CircuitBreakerConfig{FailureThreshold: 2, CooldownSeconds: 30, HalfOpenRequests: 1}.build()
+	breaker := breakers.get("gitlab.internal")
+	now := time.Now()
+
+	// a success resets the consecutive failure count
+	for _, outcome := range []circuitOutcome{circuitFailure, circuitSuccess, circuitFailure, circuitCanceled} {
+		done, err := breaker.allow(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(outcome, now)
+	}
+	assertCircuitState(t, breaker, circuitClosed)
+
+	done, _ := breaker.allow(now)
+	done(circuitFailure, now)
+	assertCircuitState(t, breaker, circuitOpen)
+
+	// requests fail fast while open
+	var circuitOpenErr *CircuitOpenError
+	if _, err := breaker.allow(now.Add(29 * time.Second)); !errors.As(err, &circuitOpenErr) {
+		t.Errorf("expected the request to be rejected while open, got %v", err)
+	}
+
+	// after the cool-down, a single trial request is let through
+	trialDone, err := breaker.allow(now.Add(30 * time.Second))
+	if err != nil {
+		t.Fatalf("expected a trial request after the cool-down, got %v", err)
+	}
+	assertCircuitState(t, breaker, circuitHalfOpen)
+	if _, err := breaker.allow(now.Add(30 * time.Second)); err == nil {
+		t.Error("expected only one trial request while half-open")
+	}
+
+	// a failed trial re-opens the circuit
+	trialDone(circuitFailure, now.Add(31*time.Second))
+	assertCircuitState(t, breaker, circuitOpen)
+
+	// a successful trial closes it
+	trialDone, _ = breaker.allow(now.Add(61 * time.Second))
+	trialDone(circuitSuccess, now.Add(61*time.Second))
+	assertCircuitState(t, breaker, circuitClosed)
+
+	if states := breakers.states(); states["gitlab.internal"] != "closed" {
+		t.Errorf("unexpected states: %v", states)
+	}
+}
+
+func TestCircuitBreakerRoundTripper(t *testing.T) {
+	server, requests := flakyServer(100, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	transport := CircuitBreakerConfig{FailureThreshold: 2, CooldownSeconds: 30, HalfOpenRequests: 1}.build().wrap(http.DefaultTransport)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if i < 2 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			continue
+		}
+		var circuitOpenErr *CircuitOpenError
+		if !errors.As(err, &circuitOpenErr) {
+			t.Errorf("expected the circuit to be open after 2 failures, got %v", err)
+		}
+	}
+
+	if *requests != 2 {
+		t.Errorf("expected 2 requests to reach the destination, got %v", *requests)
+	}
+}
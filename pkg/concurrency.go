@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultQueueTimeout = 30 * time.Second
+
+var errConcurrencyQueueFull = errors.New("queue is full")
+var errConcurrencyQueueTimeout = errors.New("timed out waiting in queue")
+
+type ConcurrencyError struct {
+	Scope string
+	Err   error
+}
+
+func (e *ConcurrencyError) Error() string {
+	return fmt.Sprintf("too many concurrent requests (%v): %v", e.Scope, e.Err)
+}
+
+func (e *ConcurrencyError) Unwrap() error {
+	return e.Err
+}
+
+// concurrencyLimiter is a semaphore with a bounded wait queue
+type concurrencyLimiter struct {
+	scope        string
+	slots        chan struct{}
+	queued       int64
+	maxQueued    int64
+	queueTimeout time.Duration
+}
+
+func newConcurrencyLimiter(scope string, limit ConcurrencyLimit) *concurrencyLimiter {
+	if limit.MaxInFlight <= 0 {
+		return nil
+	}
+
+	queueTimeout := defaultQueueTimeout
+	if limit.QueueTimeoutSeconds > 0 {
+		queueTimeout = time.Duration(limit.QueueTimeoutSeconds) * time.Second
+	}
+
+	return &concurrencyLimiter{
+		scope:        scope,
+		slots:        make(chan struct{}, limit.MaxInFlight),
+		maxQueued:    int64(limit.MaxQueued),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+	concurrencyInFlightGauge.WithLabelValues(l.scope).Dec()
+}
+
+func (l *concurrencyLimiter) reject(err error, reason string) error {
+	concurrencyRejectedCounter.WithLabelValues(l.scope, reason).Inc()
+	return &ConcurrencyError{Scope: l.scope, Err: err}
+}
+
+// acquire waits for a free slot, returning a function that releases it
+func (l *concurrencyLimiter) acquire(ctx context.Context) (func(), error) {
+	// fast path: a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		concurrencyInFlightGauge.WithLabelValues(l.scope).Inc()
+		return l.release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.queued, 1) > l.maxQueued {
+		atomic.AddInt64(&l.queued, -1)
+		return nil, l.reject(errConcurrencyQueueFull, "queue_full")
+	}
+	concurrencyQueueDepthGauge.WithLabelValues(l.scope).Inc()
+	defer func() {
+		atomic.AddInt64(&l.queued, -1)
+		concurrencyQueueDepthGauge.WithLabelValues(l.scope).Dec()
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		concurrencyQueueWaitHistogram.WithLabelValues(l.scope).Observe(time.Since(start).Seconds())
+		concurrencyInFlightGauge.WithLabelValues(l.scope).Inc()
+		return l.release, nil
+	case <-timer.C:
+		concurrencyQueueWaitHistogram.WithLabelValues(l.scope).Observe(time.Since(start).Seconds())
+		return nil, l.reject(errConcurrencyQueueTimeout, "queue_timeout")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// concurrencyLimiters holds the global limiter and lazily created per-host limiters
+type concurrencyLimiters struct {
+	config  ConcurrencyConfig
+	global  *concurrencyLimiter
+	mu      sync.Mutex
+	perHost map[string]*concurrencyLimiter
+}
+
+func (config ConcurrencyConfig) build() *concurrencyLimiters {
+	return &concurrencyLimiters{
+		config:  config,
+		global:  newConcurrencyLimiter("global", config.Global),
+		perHost: map[string]*concurrencyLimiter{},
+	}
+}
+
+func (limiters *concurrencyLimiters) limitFor(host string, hostname string) ConcurrencyLimit {
+	for i := range limiters.config.Hosts {
+		if limiters.config.Hosts[i].Host == host || limiters.config.Hosts[i].Host == hostname {
+			return limiters.config.Hosts[i].ConcurrencyLimit
+		}
+	}
+	return limiters.config.PerHost
+}
+
+func (limiters *concurrencyLimiters) hostLimiter(host string, hostname string) *concurrencyLimiter {
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+
+	limiter, exists := limiters.perHost[host]
+	if !exists {
+		// hosts are limited to the ones in the allowlist, so this map stays small
+		limiter = newConcurrencyLimiter(host, limiters.limitFor(host, hostname))
+		limiters.perHost[host] = limiter
+	}
+	return limiter
+}
+
+// acquire takes a slot for the destination host and then a global slot, returning a function that releases both
+func (limiters *concurrencyLimiters) acquire(ctx context.Context, host string, hostname string) (func(), error) {
+	releases := make([]func(), 0, 2)
+	releaseAll := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	// take the host slot first so that a slow host doesn't hold on to global slots while it waits
+	for _, limiter := range []*concurrencyLimiter{limiters.hostLimiter(host, hostname), limiters.global} {
+		if limiter == nil {
+			continue
+		}
+		release, err := limiter.acquire(ctx)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+
+	return releaseAll, nil
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	limiter := newConcurrencyLimiter("test", ConcurrencyLimit{MaxInFlight: 1, MaxQueued: 1})
+	ctx := context.Background()
+
+	release, err := limiter.acquire(ctx)
+	if err != nil {
+		t.Fatalf("first request should get a slot: %v", err)
+	}
+
+	queuedResult := make(chan error)
+	go func() {
+		queuedRelease, err := limiter.acquire(ctx)
+		if err == nil {
+			queuedRelease()
+		}
+		queuedResult <- err
+	}()
+
+	// wait for the second request to be queued
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&limiter.queued) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := limiter.acquire(ctx); !errors.Is(err, errConcurrencyQueueFull) {
+		t.Errorf("third request should be rejected with a full queue, got %v", err)
+	}
+
+	release()
+	if err := <-queuedResult; err != nil {
+		t.Errorf("queued request should get a slot once released: %v", err)
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	limiter := newConcurrencyLimiter("test", ConcurrencyLimit{MaxInFlight: 1, MaxQueued: 1})
+	limiter.queueTimeout = 10 * time.Millisecond
+
+	release, err := limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if _, err := limiter.acquire(context.Background()); !errors.Is(err, errConcurrencyQueueTimeout) {
+		t.Errorf("queued request should time out, got %v", err)
+	}
+}
+
+func TestConcurrencyLimitersPerHost(t *testing.T) {
+	limiters := ConcurrencyConfig{
+		PerHost: ConcurrencyLimit{MaxInFlight: 2},
+		Hosts: []HostConcurrencyLimit{
+			{Host: "bitbucket.internal", ConcurrencyLimit: ConcurrencyLimit{MaxInFlight: 1}},
+		},
+	}.build()
+
+	if limiters.global != nil {
+		t.Error("global limiter should be disabled by default")
+	}
+	if limiter := limiters.hostLimiter("bitbucket.internal:7990", "bitbucket.internal"); cap(limiter.slots) != 1 {
+		t.Errorf("expected bitbucket.internal to be limited to 1, got %v", cap(limiter.slots))
+	}
+	if limiter := limiters.hostLimiter("gitlab.internal", "gitlab.internal"); cap(limiter.slots) != 2 {
+		t.Errorf("expected other hosts to be limited to 2, got %v", cap(limiter.slots))
+	}
+}
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 
 	"github.com/mcuadros/go-defaults"
 	"github.com/mitchellh/mapstructure"
@@ -71,6 +73,12 @@ type WireguardPeer struct {
 	DisablePersistentKeepalive  bool         `mapstructure:"disablePersistentKeepalive" json:"disablePersistentKeepalive"`
 }
 
+type WireguardStatsConfig struct {
+	IntervalSeconds int `mapstructure:"intervalSeconds" json:"intervalSeconds" validate:"gt=0" default:"60"`
+	// HandshakeWarningSeconds is how old the last handshake with a peer can get before a warning is logged. 0 disables the warning.
+	HandshakeWarningSeconds int `mapstructure:"handshakeWarningSeconds" json:"handshakeWarningSeconds" validate:"gte=0" default:"300"`
+}
+
 type WireguardBase struct {
 	LocalAddress string                `mapstructure:"localAddress" json:"localAddress" validate:"format=ip"`
 	Dns          []string              `mapstructure:"dns" json:"dns" validate:"empty=true > format=ip"`
@@ -79,6 +87,8 @@ type WireguardBase struct {
 	ListenPort   int                   `mapstructure:"listenPort" json:"listenPort" validate:"gte=0"`
 	Peers        []WireguardPeer       `mapstructure:"peers" json:"peers" validate:"empty=false"`
 	Verbose      bool                  `mapstructure:"verbose" json:"verbose"`
+	Stats        WireguardStatsConfig  `mapstructure:"stats" json:"stats"`
+	monitor      *wireguardMonitor
 }
 
 type BitTester interface {
@@ -134,6 +144,8 @@ func LookupHttpMethod(method string) uint {
 		return MethodDelete
 	case "CONNECT":
 		return MethodConnect
+	case "OPTIONS":
+		return MethodOptions
 	case "TRACE":
 		return MethodTrace
 	}
@@ -173,25 +185,92 @@ func httpMethodsDecodeHook(f reflect.Type, t reflect.Type, data interface{}) (in
 	return ParseHttpMethods(methods), nil
 }
 
+type QueryParamRule struct {
+	Name      string `mapstructure:"name" json:"name" validate:"empty=false"`
+	Required  bool   `mapstructure:"required" json:"required"`
+	Forbidden bool   `mapstructure:"forbidden" json:"forbidden"`
+	Pattern   string `mapstructure:"pattern" json:"pattern"`
+}
+
+type PathParamRule struct {
+	Name    string   `mapstructure:"name" json:"name" validate:"empty=false"`
+	Type    string   `mapstructure:"type" json:"type"`
+	Pattern string   `mapstructure:"pattern" json:"pattern"`
+	OneOf   []string `mapstructure:"oneOf" json:"oneOf"`
+}
+
+type BodyFieldRule struct {
+	JSONPath  string   `mapstructure:"jsonPath" json:"jsonPath" validate:"empty=false"`
+	Required  bool     `mapstructure:"required" json:"required"`
+	Equals    []string `mapstructure:"equals" json:"equals"`
+	HasPrefix []string `mapstructure:"hasPrefix" json:"hasPrefix"`
+	Pattern   string   `mapstructure:"pattern" json:"pattern"`
+}
+
+type BodyPolicy struct {
+	ContentTypes   []string        `mapstructure:"contentTypes" json:"contentTypes"`
+	MaxBytes       int64           `mapstructure:"maxBytes" json:"maxBytes" validate:"gte=0"`
+	AllowedFields  []string        `mapstructure:"allowedFields" json:"allowedFields"`
+	RequiredFields []string        `mapstructure:"requiredFields" json:"requiredFields"`
+	Rules          []BodyFieldRule `mapstructure:"rules" json:"rules"`
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `mapstructure:"requestsPerSecond" json:"requestsPerSecond" validate:"gt=0"`
+	Burst             int     `mapstructure:"burst" json:"burst" validate:"gte=0"`
+	KeyParam          string  `mapstructure:"keyParam" json:"keyParam"`
+}
+
 type AllowlistItem struct {
-	URL                   string            `mapstructure:"url" json:"url"`
-	Methods               HttpMethods       `mapstructure:"methods" json:"methods"`
-	SetRequestHeaders     map[string]string `mapstructure:"setRequestHeaders" json:"setRequestHeaders"`
-	RemoveResponseHeaders []string          `mapstructure:"removeResponseHeaders" json:"removeRequestHeaders"`
-	LogRequestBody        bool              `mapstructure:"logRequestBody" json:"logRequestBody"`
-	LogRequestHeaders     bool              `mapstructure:"logRequestHeaders" json:"logRequestHeaders"`
-	LogResponseBody       bool              `mapstructure:"logResponseBody" json:"logResponseBody"`
-	LogResponseHeaders    bool              `mapstructure:"logResponseHeaders" json:"logResponseHeaders"`
+	authenticator         requestAuthenticator
+	URL                   string                  `mapstructure:"url" json:"url"`
+	Methods               HttpMethods             `mapstructure:"methods" json:"methods"`
+	SetRequestHeaders     map[string]SecretString `mapstructure:"setRequestHeaders" json:"setRequestHeaders"`
+	RemoveResponseHeaders []string                `mapstructure:"removeResponseHeaders" json:"removeRequestHeaders"`
+	PathParams            []PathParamRule         `mapstructure:"pathParams" json:"pathParams"`
+	QueryParams           []QueryParamRule        `mapstructure:"queryParams" json:"queryParams"`
+	AllowOtherQueryParams bool                    `mapstructure:"allowOtherQueryParams" json:"allowOtherQueryParams"`
+	Body                  *BodyPolicy             `mapstructure:"body" json:"body"`
+	RateLimit             *RateLimitConfig        `mapstructure:"rateLimit" json:"rateLimit"`
+	TLSProfile            string                  `mapstructure:"tlsProfile" json:"tlsProfile"`
+	Retry                 *RetryConfig            `mapstructure:"retry" json:"retry"`
+	Cache                 bool                    `mapstructure:"cache" json:"cache"`
+	Auth                  *AuthConfig             `mapstructure:"auth" json:"auth"`
+	Signing               *SigningConfig          `mapstructure:"signing" json:"signing"`
+	LogRequestBody        bool                    `mapstructure:"logRequestBody" json:"logRequestBody"`
+	LogRequestHeaders     bool                    `mapstructure:"logRequestHeaders" json:"logRequestHeaders"`
+	LogResponseBody       bool                    `mapstructure:"logResponseBody" json:"logResponseBody"`
+	LogResponseHeaders    bool                    `mapstructure:"logResponseHeaders" json:"logResponseHeaders"`
 }
 
 type Allowlist []AllowlistItem
 
+type AllowlistMatch struct {
+	*AllowlistItem
+	Params     map[string]string
+	bodyPolicy *compiledBodyPolicy
+}
+
+type RedactionConfig struct {
+	Headers     []string `mapstructure:"headers" json:"headers"`
+	QueryParams []string `mapstructure:"queryParams" json:"queryParams"`
+	JSONPaths   []string `mapstructure:"jsonPaths" json:"jsonPaths"`
+	Patterns    []string `mapstructure:"patterns" json:"patterns"`
+}
+
 type LoggingConfig struct {
-	SkipPaths          []string `mapstructure:"skipPaths" json:"skipPaths"`
-	LogRequestBody     bool     `mapstructure:"logRequestBody" json:"logRequestBody"`
-	LogRequestHeaders  bool     `mapstructure:"logRequestHeaders" json:"logRequestHeaders"`
-	LogResponseBody    bool     `mapstructure:"logResponseBody" json:"logResponseBody"`
-	LogResponseHeaders bool     `mapstructure:"logResponseHeaders" json:"logResponseHeaders"`
+	SkipPaths          []string        `mapstructure:"skipPaths" json:"skipPaths"`
+	LogRequestBody     bool            `mapstructure:"logRequestBody" json:"logRequestBody"`
+	LogRequestHeaders  bool            `mapstructure:"logRequestHeaders" json:"logRequestHeaders"`
+	LogResponseBody    bool            `mapstructure:"logResponseBody" json:"logResponseBody"`
+	LogResponseHeaders bool            `mapstructure:"logResponseHeaders" json:"logResponseHeaders"`
+	MaxBodyBytes       int             `mapstructure:"maxBodyBytes" json:"maxBodyBytes" validate:"gte=0" default:"65536"`
+	Redaction          RedactionConfig `mapstructure:"redaction" json:"redaction"`
+}
+
+type MetricsConfig struct {
+	// GinMetrics enables the generic gin_* request metrics, labeled by route
+	GinMetrics bool `mapstructure:"ginMetrics" json:"ginMetrics"`
 }
 
 type HeartbeatConfig struct {
@@ -200,39 +279,200 @@ type HeartbeatConfig struct {
 	TimeoutSeconds            int    `mapstructure:"timeoutSeconds" json:"timeoutSeconds" validate:"gt=0" default:"5"`
 	PanicAfterFailureCount    int    `mapstructure:"panicAfterFailureCount" json:"panicAfterFailureCount" validate:"gte=0"`
 	FirstHeartbeatMustSucceed bool   `mapstructure:"firstHeartbeatMustSucceed" json:"firstHeartbeatMustSucceed"`
+	status                    *heartbeatStatus
+}
+
+type AdminConfig struct {
+	// ListenAddress is a loopback address like 127.0.0.1:9090, or a unix socket like unix:/run/broker/admin.sock. Empty disables the admin API.
+	ListenAddress string       `mapstructure:"listenAddress" json:"listenAddress"`
+	Token         SecretString `mapstructure:"token" json:"token"`
+}
+
+type HealthConfig struct {
+	// ListenAddress serves the health endpoints outside of the tunnel, e.g. for Kubernetes probes. Empty disables it.
+	ListenAddress string `mapstructure:"listenAddress" json:"listenAddress"`
+	// MaxHeartbeatAgeSeconds defaults to three heartbeat intervals
+	MaxHeartbeatAgeSeconds int `mapstructure:"maxHeartbeatAgeSeconds" json:"maxHeartbeatAgeSeconds" validate:"gte=0"`
+	MaxHandshakeAgeSeconds int `mapstructure:"maxHandshakeAgeSeconds" json:"maxHandshakeAgeSeconds" validate:"gte=0" default:"300"`
+}
+
+type GitHubApp struct {
+	AppID      int64        `mapstructure:"appId" json:"appId"`
+	PrivateKey SecretString `mapstructure:"privateKey" json:"privateKey"`
 }
 
 type GitHub struct {
-	BaseURL         string `mapstructure:"baseUrl" json:"baseUrl"`
-	Token           string `mapstructure:"token" json:"token"`
-	AllowCodeAccess bool   `mapstructure:"allowCodeAccess" json:"allowCodeAccess"`
+	BaseURL         string       `mapstructure:"baseUrl" json:"baseUrl"`
+	Token           SecretString `mapstructure:"token" json:"token"`
+	App             *GitHubApp   `mapstructure:"app" json:"app"`
+	AllowCodeAccess bool         `mapstructure:"allowCodeAccess" json:"allowCodeAccess"`
 }
 
 type GitLab struct {
-	BaseURL         string `mapstructure:"baseUrl" json:"baseUrl"`
-	Token           string `mapstructure:"token" json:"token"`
-	AllowCodeAccess bool   `mapstructure:"allowCodeAccess" json:"allowCodeAccess"`
+	BaseURL         string       `mapstructure:"baseUrl" json:"baseUrl"`
+	Token           SecretString `mapstructure:"token" json:"token"`
+	AllowCodeAccess bool         `mapstructure:"allowCodeAccess" json:"allowCodeAccess"`
 }
 
 type BitBucket struct {
-	BaseURL string `mapstructure:"baseUrl" json:"baseUrl"`
-	Token   string `mapstructure:"token" json:"token"`
+	BaseURL string       `mapstructure:"baseUrl" json:"baseUrl"`
+	Token   SecretString `mapstructure:"token" json:"token"`
+}
+
+type TLSProfile struct {
+	Name             string   `mapstructure:"name" json:"name" validate:"empty=false"`
+	Hosts            []string `mapstructure:"hosts" json:"hosts"`
+	CACerts          []string `mapstructure:"caCerts" json:"caCerts"`
+	ClientCert       string   `mapstructure:"clientCert" json:"clientCert"`
+	ClientKey        string   `mapstructure:"clientKey" json:"clientKey"`
+	MinVersion       string   `mapstructure:"minVersion" json:"minVersion"`
+	ServerName       string   `mapstructure:"serverName" json:"serverName"`
+	PinnedSPKISHA256 []string `mapstructure:"pinnedSPKISHA256" json:"pinnedSPKISHA256"`
+}
+
+type ForwardProxyRule struct {
+	Hosts          []string `mapstructure:"hosts" json:"hosts"`
+	Direct         bool     `mapstructure:"direct" json:"direct"`
+	URL            string   `mapstructure:"url" json:"url"`
+	CredentialFile string   `mapstructure:"credentialFile" json:"credentialFile"`
+}
+
+type ForwardProxyConfig struct {
+	Rules []ForwardProxyRule `mapstructure:"rules" json:"rules"`
 }
 
 type HttpClientConfig struct {
-	AdditionalCACerts []string `mapstructure:"additionalCACerts" json:"additionalCACerts"`
+	AdditionalCACerts []string           `mapstructure:"additionalCACerts" json:"additionalCACerts"`
+	TLSProfiles       []TLSProfile       `mapstructure:"tlsProfiles" json:"tlsProfiles"`
+	Proxy             ForwardProxyConfig `mapstructure:"proxy" json:"proxy"`
+}
+
+type OAuth2Config struct {
+	TokenURL     string       `mapstructure:"tokenUrl" json:"tokenUrl"`
+	GrantType    string       `mapstructure:"grantType" json:"grantType"`
+	ClientID     string       `mapstructure:"clientId" json:"clientId"`
+	ClientSecret SecretString `mapstructure:"clientSecret" json:"clientSecret"`
+	RefreshToken SecretString `mapstructure:"refreshToken" json:"refreshToken"`
+	Scopes       []string     `mapstructure:"scopes" json:"scopes"`
+	ClientAuth   string       `mapstructure:"clientAuth" json:"clientAuth"`
+}
+
+type AuthConfig struct {
+	Credential string        `mapstructure:"credential" json:"credential"`
+	OAuth2     *OAuth2Config `mapstructure:"oauth2" json:"oauth2"`
+}
+
+type CredentialConfig struct {
+	Name   string        `mapstructure:"name" json:"name"`
+	OAuth2 *OAuth2Config `mapstructure:"oauth2" json:"oauth2"`
+}
+
+type SigV4Config struct {
+	Service         string       `mapstructure:"service" json:"service"`
+	Region          string       `mapstructure:"region" json:"region"`
+	AccessKeyID     SecretString `mapstructure:"accessKeyId" json:"accessKeyId"`
+	SecretAccessKey SecretString `mapstructure:"secretAccessKey" json:"secretAccessKey"`
+	SessionToken    SecretString `mapstructure:"sessionToken" json:"sessionToken"`
+	UnsignedPayload bool         `mapstructure:"unsignedPayload" json:"unsignedPayload"`
+}
+
+type HMACSigningConfig struct {
+	Key             SecretString `mapstructure:"key" json:"key"`
+	Algorithm       string       `mapstructure:"algorithm" json:"algorithm"`
+	Encoding        string       `mapstructure:"encoding" json:"encoding"`
+	SignatureHeader string       `mapstructure:"signatureHeader" json:"signatureHeader"`
+	TimestampHeader string       `mapstructure:"timestampHeader" json:"timestampHeader"`
+	SignedHeaders   []string     `mapstructure:"signedHeaders" json:"signedHeaders"`
+}
+
+type SigningConfig struct {
+	SigV4        *SigV4Config       `mapstructure:"sigv4" json:"sigv4"`
+	HMAC         *HMACSigningConfig `mapstructure:"hmac" json:"hmac"`
+	MaxBodyBytes int64              `mapstructure:"maxBodyBytes" json:"maxBodyBytes" validate:"gte=0"`
+}
+
+type RetryConfig struct {
+	MaxAttempts           int         `mapstructure:"maxAttempts" json:"maxAttempts" validate:"gte=0"`
+	Methods               HttpMethods `mapstructure:"methods" json:"methods"`
+	StatusCodes           []int       `mapstructure:"statusCodes" json:"statusCodes"`
+	Errors                []string    `mapstructure:"errors" json:"errors"`
+	InitialBackoffSeconds float64     `mapstructure:"initialBackoffSeconds" json:"initialBackoffSeconds" validate:"gte=0"`
+	MaxBackoffSeconds     float64     `mapstructure:"maxBackoffSeconds" json:"maxBackoffSeconds" validate:"gte=0"`
+	IgnoreRetryAfter      bool        `mapstructure:"ignoreRetryAfter" json:"ignoreRetryAfter"`
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int   `mapstructure:"failureThreshold" json:"failureThreshold" validate:"gte=0"`
+	CooldownSeconds  int   `mapstructure:"cooldownSeconds" json:"cooldownSeconds" validate:"gte=0" default:"30"`
+	HalfOpenRequests int   `mapstructure:"halfOpenRequests" json:"halfOpenRequests" validate:"gte=0" default:"1"`
+	StatusCodes      []int `mapstructure:"statusCodes" json:"statusCodes"`
+}
+
+type ResponseCacheConfig struct {
+	MaxEntries    int    `mapstructure:"maxEntries" json:"maxEntries" validate:"gte=0" default:"1000"`
+	MaxBytes      int64  `mapstructure:"maxBytes" json:"maxBytes" validate:"gte=0" default:"67108864"`
+	MaxEntryBytes int64  `mapstructure:"maxEntryBytes" json:"maxEntryBytes" validate:"gte=0" default:"1048576"`
+	Directory     string `mapstructure:"directory" json:"directory"`
+	MaxDiskBytes  int64  `mapstructure:"maxDiskBytes" json:"maxDiskBytes" validate:"gte=0" default:"1073741824"`
+}
+
+type AuditConfig struct {
+	Path     string       `mapstructure:"path" json:"path"`
+	MaxBytes int64        `mapstructure:"maxBytes" json:"maxBytes" validate:"gte=0" default:"104857600"`
+	MaxFiles int          `mapstructure:"maxFiles" json:"maxFiles" validate:"gte=0" default:"10"`
+	HMACKey  SecretString `mapstructure:"hmacKey" json:"hmacKey"`
+}
+
+type HistoryConfig struct {
+	Directory   string `mapstructure:"directory" json:"directory"`
+	MaxAgeHours int    `mapstructure:"maxAgeHours" json:"maxAgeHours" validate:"gte=0" default:"720"`
+	MaxBytes    int64  `mapstructure:"maxBytes" json:"maxBytes" validate:"gte=0" default:"268435456"`
+}
+
+type ConcurrencyLimit struct {
+	MaxInFlight         int `mapstructure:"maxInFlight" json:"maxInFlight" validate:"gte=0"`
+	MaxQueued           int `mapstructure:"maxQueued" json:"maxQueued" validate:"gte=0"`
+	QueueTimeoutSeconds int `mapstructure:"queueTimeoutSeconds" json:"queueTimeoutSeconds" validate:"gte=0"`
+}
+
+type HostConcurrencyLimit struct {
+	Host             string `mapstructure:"host" json:"host" validate:"empty=false"`
+	ConcurrencyLimit `mapstructure:",squash"`
+}
+
+type ConcurrencyConfig struct {
+	Global  ConcurrencyLimit       `mapstructure:"global" json:"global"`
+	PerHost ConcurrencyLimit       `mapstructure:"perHost" json:"perHost"`
+	Hosts   []HostConcurrencyLimit `mapstructure:"hosts" json:"hosts"`
 }
 
 type InboundProxyConfig struct {
-	Wireguard       WireguardBase    `mapstructure:"wireguard" json:"wireguard"`
-	Allowlist       Allowlist        `mapstructure:"allowlist" json:"allowlist"`
-	ProxyListenPort int              `mapstructure:"proxyListenPort" json:"proxyListenPort" validate:"gte=0" default:"80"`
-	Logging         LoggingConfig    `mapstructure:"logging" json:"logging"`
-	Heartbeat       HeartbeatConfig  `mapstructure:"heartbeat" json:"heartbeat"`
-	GitHub          *GitHub          `mapstructure:"github" json:"github"`
-	GitLab          *GitLab          `mapstructure:"gitlab" json:"gitlab"`
-	BitBucket       *BitBucket       `mapstructure:"bitbucket" json:"bitbucket"`
-	HttpClient      HttpClientConfig `mapstructure:"httpClient" json:"httpClient"`
+	Wireguard       WireguardBase        `mapstructure:"wireguard" json:"wireguard"`
+	Allowlist       Allowlist            `mapstructure:"allowlist" json:"allowlist"`
+	Denylist        Allowlist            `mapstructure:"denylist" json:"denylist"`
+	ProxyListenPort int                  `mapstructure:"proxyListenPort" json:"proxyListenPort" validate:"gte=0" default:"80"`
+	Logging         LoggingConfig        `mapstructure:"logging" json:"logging"`
+	Heartbeat       HeartbeatConfig      `mapstructure:"heartbeat" json:"heartbeat"`
+	GitHub          *GitHub              `mapstructure:"github" json:"github"`
+	GitLab          *GitLab              `mapstructure:"gitlab" json:"gitlab"`
+	BitBucket       *BitBucket           `mapstructure:"bitbucket" json:"bitbucket"`
+	HttpClient      HttpClientConfig     `mapstructure:"httpClient" json:"httpClient"`
+	RateLimit       *RateLimitConfig     `mapstructure:"rateLimit" json:"rateLimit"`
+	Concurrency     ConcurrencyConfig    `mapstructure:"concurrency" json:"concurrency"`
+	Retry           RetryConfig          `mapstructure:"retry" json:"retry"`
+	CircuitBreaker  CircuitBreakerConfig `mapstructure:"circuitBreaker" json:"circuitBreaker"`
+	Cache           ResponseCacheConfig  `mapstructure:"cache" json:"cache"`
+	Credentials     []CredentialConfig   `mapstructure:"credentials" json:"credentials"`
+	Audit           AuditConfig          `mapstructure:"audit" json:"audit"`
+	History         HistoryConfig        `mapstructure:"history" json:"history"`
+	Metrics         MetricsConfig        `mapstructure:"metrics" json:"metrics"`
+	Health          HealthConfig         `mapstructure:"health" json:"health"`
+	Admin           AdminConfig          `mapstructure:"admin" json:"admin"`
+	readiness       *readinessChecker
+	// state is swapped when the config is reloaded
+	state    *atomic.Pointer[inboundProxyState]
+	auditLog *AuditLog
+	history  *RequestHistory
 }
 
 type FilteredRelayConfig struct {
@@ -255,15 +495,82 @@ type OutboundProxyConfig struct {
 	Relay      map[string]FilteredRelayConfig `mapstructure:"relay" json:"relay"`
 	Logging    LoggingConfig                  `mapstructure:"logging" json:"logging"`
 	ListenPort int                            `mapstructure:"listenPort" json:"listenPort" validate:"gte=0" default:"8080"`
+	Metrics    MetricsConfig                  `mapstructure:"metrics" json:"metrics"`
+}
+
+type SecretsConfig struct {
+	AllowExec bool `mapstructure:"allowExec" json:"allowExec"`
 }
 
 type Config struct {
 	Inbound  InboundProxyConfig  `mapstructure:"inbound" json:"inbound"`
 	Outbound OutboundProxyConfig `mapstructure:"outbound" json:"outbound"`
+	Secrets  SecretsConfig       `mapstructure:"secrets" json:"secrets"`
+}
+
+// FetchDefaultConfig downloads the default config Semgrep provides for a deployment
+func FetchDefaultConfig(deploymentId int) ([]byte, error) {
+	hostname := os.Getenv("SEMGREP_HOSTNAME")
+	if hostname == "" {
+		hostname = "semgrep.dev"
+	}
+	url := url.URL{
+		Scheme: "https",
+		Host:   hostname,
+		Path:   fmt.Sprintf("/api/broker/%d/default-config", deploymentId),
+	}
+
+	resp, err := http.Get(url.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to request default broker config from %v: %v", hostname, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to request default config from %s: HTTP %v", url.String(), resp.StatusCode)
+	}
+
+	defaultConfig, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default config from %v: %v", hostname, err)
+	}
+	return defaultConfig, nil
+}
+
+// mergeDefaultConfig merges the default config downloaded from Semgrep. It's not trusted to reference secrets,
+// since those are resolved on the broker's machine.
+func mergeDefaultConfig(v *viper.Viper, defaultConfig []byte) error {
+	remote := viper.New()
+	remote.SetConfigType("json")
+	if err := remote.ReadConfig(bytes.NewReader(defaultConfig)); err != nil {
+		return err
+	}
+	settings := remote.AllSettings()
+	if err := checkSecretReferences(settings, func(string, string) error {
+		return fmt.Errorf("secret references are only allowed in local config files")
+	}); err != nil {
+		return err
+	}
+	return v.MergeConfigMap(settings)
 }
 
 func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
+	var defaultConfig []byte
+	if deploymentId > 0 {
+		var err error
+		if defaultConfig, err = FetchDefaultConfig(deploymentId); err != nil {
+			return nil, err
+		}
+	}
+	return LoadConfigWithDefault(configFiles, defaultConfig)
+}
+
+// LoadConfigWithDefault loads the config files on top of a default config that was already fetched with
+// FetchDefaultConfig, e.g. so that reloading the config doesn't download it again. defaultConfig may be nil.
+func LoadConfigWithDefault(configFiles []string, defaultConfig []byte) (*Config, error) {
 	config := new(Config)
+	// use a fresh viper for each load, so that reloading doesn't merge into the previously loaded config
+	v := viper.New()
 
 	tokenString, err := LoadTokenFromEnv()
 	if err != nil {
@@ -280,56 +587,31 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 		config.Inbound.Wireguard.PrivateKey = token.WireguardCredential.PrivateKey
 	}
 
-	if deploymentId > 0 {
-		hostname := os.Getenv("SEMGREP_HOSTNAME")
-		if hostname == "" {
-			hostname = "semgrep.dev"
-		}
-		url := url.URL{
-			Scheme: "https",
-			Host:   hostname,
-			Path:   fmt.Sprintf("/api/broker/%d/default-config", deploymentId),
-		}
-
-		resp, err := http.Get(url.String())
-		if err != nil {
-			return nil, fmt.Errorf("failed to request default broker config from %v: %v", hostname, err)
-		}
-
-		if resp.StatusCode != 200 {
-			return nil, fmt.Errorf("failed to request default config from %s: HTTP %v", url.String(), resp.StatusCode)
-		}
-
-		f, err := os.CreateTemp("", "default-config*.json")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create temp file to store default config: %v", err)
-		}
-		defer func() {
-			f.Close()
-			os.Remove(f.Name())
-		}()
-
-		io.Copy(f, resp.Body)
-		defer resp.Body.Close()
-
-		viper.SetConfigFile(f.Name())
-		if err := viper.MergeInConfig(); err != nil {
-			return nil, fmt.Errorf("failed to merge config file '%s': %v", f.Name(), err)
+	if defaultConfig != nil {
+		if err := mergeDefaultConfig(v, defaultConfig); err != nil {
+			return nil, fmt.Errorf("failed to merge default config: %v", err)
 		}
 	}
 
 	for i := range configFiles {
-		viper.SetConfigFile(configFiles[i])
-		if err := viper.MergeInConfig(); err != nil {
+		v.SetConfigFile(configFiles[i])
+		if err := v.MergeInConfig(); err != nil {
 			return nil, fmt.Errorf("failed to merge config file '%s': %v", configFiles[i], err)
 		}
 	}
-	if err := viper.Unmarshal(config, func(dc *mapstructure.DecoderConfig) {
+	if err := v.Unmarshal(config, func(dc *mapstructure.DecoderConfig) {
 		dc.DecodeHook = mapstructure.ComposeDecodeHookFunc(base64StringDecodeHook, httpMethodsDecodeHook)
 	}); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %v", err)
 	}
 	defaults.SetDefaults(config)
+	if !v.IsSet("inbound.health.maxHeartbeatAgeSeconds") {
+		config.Inbound.Health.MaxHeartbeatAgeSeconds = 3 * config.Inbound.Heartbeat.IntervalSeconds
+	}
+
+	if err := checkSecretReferences(v.AllSettings(), config.Secrets.checkReference); err != nil {
+		return nil, err
+	}
 
 	if config.Inbound.GitHub != nil {
 		gitHub := config.Inbound.GitHub
@@ -339,13 +621,30 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 			return nil, fmt.Errorf("failed to parse github base URL: %v", err)
 		}
 
-		var headers map[string]string
+		if gitHub.Token != "" && gitHub.App != nil {
+			return nil, fmt.Errorf("github token and app cannot both be set")
+		}
+
+		// with a github app, the broker creates its own credentials for each request
+		var appTokenSource *gitHubAppTokenSource
+		if gitHub.App != nil {
+			appTokenSource = newGitHubAppTokenSource(gitHub.App, gitHubBaseUrl)
+		}
+		gitHubAuth := func(ownerParam string) requestAuthenticator {
+			if appTokenSource == nil {
+				return nil
+			}
+			return &gitHubAppAuth{source: appTokenSource, ownerParam: ownerParam}
+		}
+
+		var headers map[string]SecretString
 		if gitHub.Token != "" {
-			headers = map[string]string{
-				"Authorization": fmt.Sprintf("Bearer %v", gitHub.Token),
+			registerLiteralSecret(gitHub.Token)
+			headers = map[string]SecretString{
+				"Authorization": "Bearer " + gitHub.Token,
 			}
 		} else {
-			headers = map[string]string{}
+			headers = map[string]SecretString{}
 		}
 
 		config.Inbound.Allowlist = append(config.Inbound.Allowlist,
@@ -354,48 +653,56 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 				URL:               gitHubBaseUrl.JoinPath("/repos/:owner/:repo").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth("owner"),
 			},
 			// PR info
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/repos/:owner/:repo/pulls").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth("owner"),
 			},
 			// post PR comment
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/repos/:owner/:repo/pulls/:number/comments").String(),
 				Methods:           ParseHttpMethods([]string{"POST"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth("owner"),
 			},
 			// post issue comment
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/repos/:owner/:repo/issues/:number/comments").String(),
 				Methods:           ParseHttpMethods([]string{"POST"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth("owner"),
 			},
 			// check app installation for an org
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/orgs/:org/installation").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth(""),
 			},
 			// check repos for an org
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/orgs/:org/repos").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth("org"),
 			},
 			// check app installation for a personal account
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/users/:user/installation").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth(""),
 			},
 			// check repo installation for a personal account
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/users/:user/installation/repositories").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
 				SetRequestHeaders: headers,
+				authenticator:     gitHubAuth("user"),
 			},
 			// initiate app installation
 			AllowlistItem{
@@ -403,7 +710,8 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 				Methods:           ParseHttpMethods([]string{"POST"}),
 				SetRequestHeaders: headers,
 			},
-			// get app installation
+			// get app installation. These two aren't authenticated with the broker's own app: the access_tokens
+			// response is an installation token, which Semgrep must never see.
 			AllowlistItem{
 				URL:               gitHubBaseUrl.JoinPath("/app").String(),
 				Methods:           ParseHttpMethods([]string{"GET"}),
@@ -422,12 +730,14 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 					URL:               gitHubBaseUrl.JoinPath("/repos/:repo/contents/:filepath").String(),
 					Methods:           ParseHttpMethods([]string{"GET"}),
 					SetRequestHeaders: headers,
+					authenticator:     gitHubAuth("repo"),
 				},
 				// Commits
 				AllowlistItem{
 					URL:               gitHubBaseUrl.JoinPath("/repos/:repo/commits").String(),
 					Methods:           ParseHttpMethods([]string{"GET"}),
 					SetRequestHeaders: headers,
+					authenticator:     gitHubAuth("repo"),
 				},
 			)
 		}
@@ -441,13 +751,14 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 			return nil, fmt.Errorf("failed to parse gitlab base URL: %v", err)
 		}
 
-		var headers map[string]string
+		var headers map[string]SecretString
 		if gitLab.Token != "" {
-			headers = map[string]string{
+			registerLiteralSecret(gitLab.Token)
+			headers = map[string]SecretString{
 				"PRIVATE-TOKEN": gitLab.Token,
 			}
 		} else {
-			headers = map[string]string{}
+			headers = map[string]SecretString{}
 		}
 
 		config.Inbound.Allowlist = append(config.Inbound.Allowlist,
@@ -554,6 +865,7 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 					URL:               gitLabBaseUrl.JoinPath("/projects/:project/repository/files/:filepath").String(),
 					Methods:           ParseHttpMethods([]string{"GET"}),
 					SetRequestHeaders: headers,
+					QueryParams:       []QueryParamRule{{Name: "ref"}},
 				},
 				// Commits
 				AllowlistItem{
@@ -586,13 +898,14 @@ func LoadConfig(configFiles []string, deploymentId int) (*Config, error) {
 			return nil, fmt.Errorf("failed to parse bitbucket base URL: %v", err)
 		}
 
-		var headers map[string]string
+		var headers map[string]SecretString
 		if bitBucket.Token != "" {
-			headers = map[string]string{
-				"Authorization": fmt.Sprintf("Bearer %v", bitBucket.Token),
+			registerLiteralSecret(bitBucket.Token)
+			headers = map[string]SecretString{
+				"Authorization": "Bearer " + bitBucket.Token,
 			}
 		} else {
-			headers = map[string]string{}
+			headers = map[string]SecretString{}
 		}
 
 		config.Inbound.Allowlist = append(config.Inbound.Allowlist,
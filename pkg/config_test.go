@@ -106,6 +106,11 @@ func TestBitSetStringParse(t *testing.T) {
 	if bsGetPost.Test(MethodDelete) != false {
 		t.Fail()
 	}
+
+	bsOptions := ParseHttpMethods([]string{"OPTIONS"})
+	if bsOptions.Test(MethodOptions) != true {
+		t.Fail()
+	}
 }
 
 func TestHttpMethodsDecodeHook(t *testing.T) {
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+var forwardProxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// ForwardProxyError is returned when the forward proxy, rather than the destination, fails the request
+type ForwardProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ForwardProxyError) Error() string {
+	return fmt.Sprintf("forward proxy %v: %v", e.Proxy, e.Err)
+}
+
+func (e *ForwardProxyError) Unwrap() error {
+	return e.Err
+}
+
+// IsForwardProxyError checks whether a round trip error came from connecting through a forward proxy
+func IsForwardProxyError(err error) bool {
+	var proxyErr *ForwardProxyError
+	if errors.As(err, &proxyErr) {
+		return true
+	}
+	// net/http wraps errors dialing the proxy as "proxyconnect", and the SOCKS dialer reports errors as "socks connect"
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks ")
+	}
+	return false
+}
+
+// hostMatchesPatterns checks the host (with or without port) against glob patterns like *.example.com
+func hostMatchesPatterns(patterns []string, host string, hostname string) bool {
+	for _, pattern := range patterns {
+		if matches, _ := path.Match(pattern, host); matches {
+			return true
+		}
+		if matches, _ := path.Match(pattern, hostname); matches {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHostPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %v: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (rule ForwardProxyRule) Validate() error {
+	if err := validateHostPatterns(rule.Hosts); err != nil {
+		return fmt.Errorf("proxy rule: %v", err)
+	}
+	if rule.Direct == (rule.URL != "") {
+		return fmt.Errorf("proxy rule for %v must set exactly one of direct or url", rule.Hosts)
+	}
+	if rule.Direct {
+		if rule.CredentialFile != "" {
+			return fmt.Errorf("proxy rule for %v: credentialFile cannot be used with direct", rule.Hosts)
+		}
+		return nil
+	}
+	proxyUrl, err := url.Parse(rule.URL)
+	if err != nil {
+		return fmt.Errorf("proxy rule for %v: invalid url: %v", rule.Hosts, err)
+	}
+	if !stringInSlice(proxyUrl.Scheme, forwardProxySchemes) || proxyUrl.Host == "" {
+		return fmt.Errorf("proxy rule for %v: url must be an http, https, socks5, or socks5h url with a host", rule.Hosts)
+	}
+	return nil
+}
+
+// loadProxyCredential reads a "username:password" credential from a file
+func loadProxyCredential(credentialFile string) (*url.Userinfo, error) {
+	contents, err := os.ReadFile(credentialFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy credential: %v", err)
+	}
+	username, password, found := strings.Cut(strings.TrimSpace(string(contents)), ":")
+	if !found || username == "" {
+		return nil, fmt.Errorf("proxy credential file %v must contain username:password", credentialFile)
+	}
+	return url.UserPassword(username, password), nil
+}
+
+type forwardProxyRule struct {
+	hosts    []string
+	proxyUrl *url.URL
+}
+
+// proxyFunc returns a function for http.Transport.Proxy. The first rule matching the destination host wins.
+// Destinations that don't match any rule use the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func (config *ForwardProxyConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	rules := make([]forwardProxyRule, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		compiled := forwardProxyRule{hosts: rule.Hosts}
+		if !rule.Direct {
+			proxyUrl, err := url.Parse(rule.URL)
+			if err != nil {
+				return nil, err
+			}
+			if rule.CredentialFile != "" {
+				proxyUrl.User, err = loadProxyCredential(rule.CredentialFile)
+				if err != nil {
+					return nil, err
+				}
+			}
+			compiled.proxyUrl = proxyUrl
+		}
+		rules = append(rules, compiled)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		for _, rule := range rules {
+			if len(rule.hosts) == 0 || hostMatchesPatterns(rule.hosts, req.URL.Host, req.URL.Hostname()) {
+				return rule.proxyUrl, nil
+			}
+		}
+		return http.ProxyFromEnvironment(req)
+	}, nil
+}
+
+// checkProxyConnectResponse turns a failed CONNECT into a ForwardProxyError, since net/http doesn't distinguish it from other errors
+func checkProxyConnectResponse(ctx context.Context, proxyUrl *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+	if connectRes.StatusCode != http.StatusOK {
+		return &ForwardProxyError{Proxy: proxyUrl.Redacted(), Err: fmt.Errorf("CONNECT %v: %v", connectReq.Host, connectRes.Status)}
+	}
+	return nil
+}
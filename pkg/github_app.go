@@ -0,0 +1,289 @@
+package pkg
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gitHubAppJWTLifetime is kept under GitHub's 10 minute maximum
+const gitHubAppJWTLifetime = 9 * time.Minute
+
+// gitHubTokenRefreshWindow is how long before expiry an installation token is replaced
+const gitHubTokenRefreshWindow = 5 * time.Minute
+
+func (app *GitHubApp) Validate() error {
+	if app == nil {
+		return nil
+	}
+	if app.AppID <= 0 {
+		return fmt.Errorf("github app: appId is required")
+	}
+	if app.PrivateKey == "" {
+		return fmt.Errorf("github app: privateKey is required")
+	}
+	return nil
+}
+
+func parseGitHubAppKey(privateKeyPem string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("github app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse github app private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("github app private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signGitHubAppJWT creates the RS256 JWT an app uses to authenticate as itself
+func signGitHubAppJWT(appId int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// backdate to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(gitHubAppJWTLifetime).Unix(),
+		"iss": fmt.Sprint(appId),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+type gitHubInstallationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// gitHubAppTokenSource mints and caches installation access tokens for each account the app is installed on
+type gitHubAppTokenSource struct {
+	app     *GitHubApp
+	baseUrl *url.URL
+
+	// mu guards the fields below. It's never held during a request to GitHub.
+	mu            sync.Mutex
+	keyPem        string
+	key           *rsa.PrivateKey
+	installations map[string]int64
+	tokens        map[string]gitHubInstallationToken
+	// ownerLocks make concurrent requests for the same account wait for a single token to be minted
+	ownerLocks map[string]*sync.Mutex
+}
+
+func newGitHubAppTokenSource(app *GitHubApp, baseUrl *url.URL) *gitHubAppTokenSource {
+	return &gitHubAppTokenSource{
+		app:           app,
+		baseUrl:       baseUrl,
+		installations: map[string]int64{},
+		tokens:        map[string]gitHubInstallationToken{},
+		ownerLocks:    map[string]*sync.Mutex{},
+	}
+}
+
+// jwt must be called with the lock held
+func (source *gitHubAppTokenSource) jwt(now time.Time) (string, error) {
+	// the key may be a secret reference, so re-parse it if it was rotated
+	keyPem, err := source.app.PrivateKey.Resolve()
+	if err != nil {
+		return "", err
+	}
+	if source.key == nil || keyPem != source.keyPem {
+		key, err := parseGitHubAppKey(keyPem)
+		if err != nil {
+			return "", err
+		}
+		source.key = key
+		source.keyPem = keyPem
+	}
+
+	token, err := signGitHubAppJWT(source.app.AppID, source.key, now)
+	if err != nil {
+		return "", err
+	}
+	RegisterSecret(token)
+	return token, nil
+}
+
+// call sends an app-authenticated request to the GitHub API and decodes the JSON response
+func (source *gitHubAppTokenSource) call(ctx context.Context, transport http.RoundTripper, jwt string, method string, path string, expectedStatus int, result interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, source.baseUrl.JoinPath(path).String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := (&http.Client{Transport: transport, Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, fmt.Errorf("%v %v: HTTP %v", method, req.URL.Path, resp.StatusCode)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+}
+
+// lookupInstallationId finds the app's installation on the account
+func (source *gitHubAppTokenSource) lookupInstallationId(ctx context.Context, transport http.RoundTripper, jwt string, owner string) (int64, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	statusCode, err := source.call(ctx, transport, jwt, "GET", fmt.Sprintf("/orgs/%v/installation", url.PathEscape(owner)), http.StatusOK, &installation)
+	if statusCode == http.StatusNotFound {
+		// not an org, so try a personal account
+		_, err = source.call(ctx, transport, jwt, "GET", fmt.Sprintf("/users/%v/installation", url.PathEscape(owner)), http.StatusOK, &installation)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find github app installation for %v: %v", owner, err)
+	}
+	return installation.ID, nil
+}
+
+func (source *gitHubAppTokenSource) ownerLock(owner string) *sync.Mutex {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	lock, exists := source.ownerLocks[owner]
+	if !exists {
+		lock = &sync.Mutex{}
+		source.ownerLocks[owner] = lock
+	}
+	return lock
+}
+
+// installationToken returns a cached installation token for the account, minting a new one if it's close to expiring
+func (source *gitHubAppTokenSource) installationToken(ctx context.Context, transport http.RoundTripper, owner string, now time.Time) (string, error) {
+	owner = strings.ToLower(owner)
+
+	// other accounts aren't held up while a token is minted for this one
+	ownerLock := source.ownerLock(owner)
+	ownerLock.Lock()
+	defer ownerLock.Unlock()
+
+	source.mu.Lock()
+	if cached, exists := source.tokens[owner]; exists && now.Add(gitHubTokenRefreshWindow).Before(cached.ExpiresAt) {
+		source.mu.Unlock()
+		return cached.Token, nil
+	}
+	id, idCached := source.installations[owner]
+	jwt, err := source.jwt(now)
+	source.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if !idCached {
+		id, err = source.lookupInstallationId(ctx, transport, jwt, owner)
+		if err != nil {
+			return "", err
+		}
+		source.mu.Lock()
+		source.installations[owner] = id
+		source.mu.Unlock()
+	}
+
+	var token gitHubInstallationToken
+	if _, err := source.call(ctx, transport, jwt, "POST", fmt.Sprintf("/app/installations/%d/access_tokens", id), http.StatusCreated, &token); err != nil {
+		// the app may have been reinstalled with a new installation id
+		source.mu.Lock()
+		delete(source.installations, owner)
+		source.mu.Unlock()
+		return "", fmt.Errorf("failed to create github app installation token for %v: %v", owner, err)
+	}
+
+	RegisterSecret(token.Token)
+	source.mu.Lock()
+	source.tokens[owner] = token
+	source.mu.Unlock()
+	log.WithField("owner", owner).WithField("installation_id", id).WithField("expires_at", token.ExpiresAt).Info("github_app.token_refreshed")
+	return token.Token, nil
+}
+
+func (source *gitHubAppTokenSource) appJWT(now time.Time) (string, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	return source.jwt(now)
+}
+
+// reuseGitHubAppTokenSource carries the previous config's github app token source over if the app is unchanged,
+// so that a reload doesn't discard the installation tokens it has cached
+func (config *InboundProxyConfig) reuseGitHubAppTokenSource(previous *InboundProxyConfig) {
+	if previous == nil {
+		return
+	}
+	var previousSource *gitHubAppTokenSource
+	for i := range previous.Allowlist {
+		if auth, ok := previous.Allowlist[i].authenticator.(*gitHubAppAuth); ok {
+			previousSource = auth.source
+			break
+		}
+	}
+	if previousSource == nil {
+		return
+	}
+	for i := range config.Allowlist {
+		auth, ok := config.Allowlist[i].authenticator.(*gitHubAppAuth)
+		if ok && auth.source.baseUrl.String() == previousSource.baseUrl.String() && configEqual(reflect.ValueOf(auth.source.app), reflect.ValueOf(previousSource.app)) {
+			auth.source = previousSource
+		}
+	}
+}
+
+// gitHubAppAuth authenticates a preset allowlist item with the GitHub App. Items without an owner param are authenticated as the app itself.
+type gitHubAppAuth struct {
+	source     *gitHubAppTokenSource
+	ownerParam string
+}
+
+func (auth *gitHubAppAuth) authHeaders(ctx context.Context, params map[string]string, transport http.RoundTripper) (map[string]string, error) {
+	if auth.ownerParam == "" {
+		jwt, err := auth.source.appJWT(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"Authorization": "Bearer " + jwt}, nil
+	}
+
+	// params like :repo may be "owner/repo"
+	owner, _, _ := strings.Cut(params[auth.ownerParam], "/")
+	if owner == "" {
+		return nil, fmt.Errorf("no github account in path param %v", auth.ownerParam)
+	}
+
+	token, err := auth.source.installationToken(ctx, transport, owner, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"Authorization": "Bearer " + token}, nil
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// verifyGitHubAppJWT checks the signature and issuer of an app JWT
+func verifyGitHubAppJWT(t *testing.T, key *rsa.PrivateKey, authorization string) {
+	jwt, found := strings.CutPrefix(authorization, "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if !found || len(parts) != 3 {
+		t.Errorf("expected a bearer JWT, got %v", authorization)
+		return
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Errorf("invalid JWT signature: %v", err)
+	}
+	claims := map[string]interface{}{}
+	claimsJson, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(claimsJson, &claims)
+	if claims["iss"] != "1234" {
+		t.Errorf("unexpected JWT issuer: %v", claims["iss"])
+	}
+}
+
+func TestGitHubAppAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	var tokensCreated int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyGitHubAppJWT(t, key, r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v3/orgs/acme/installation":
+			w.Write([]byte(`{"id": 42}`))
+		case "/api/v3/users/octocat/installation":
+			w.Write([]byte(`{"id": 43}`))
+		case "/api/v3/app/installations/42/access_tokens", "/api/v3/app/installations/43/access_tokens":
+			n := atomic.AddInt64(&tokensCreated, 1)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "ghs_token%d", "expires_at": "%v"}`, n, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	baseUrl, _ := url.Parse(server.URL + "/api/v3")
+	source := newGitHubAppTokenSource(&GitHubApp{AppID: 1234, PrivateKey: SecretString(keyPem)}, baseUrl)
+	repoAuth := &gitHubAppAuth{source: source, ownerParam: "owner"}
+
+	assertAuthorization := func(auth *gitHubAppAuth, params map[string]string, expected string) {
+		headers, err := auth.authHeaders(context.Background(), params, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headers["Authorization"] != expected {
+			t.Errorf("expected %v, got %v", expected, headers["Authorization"])
+		}
+	}
+
+	assertAuthorization(repoAuth, map[string]string{"owner": "acme", "repo": "widgets"}, "Bearer ghs_token1")
+	// tokens are cached per account
+	assertAuthorization(repoAuth, map[string]string{"owner": "ACME", "repo": "gadgets"}, "Bearer ghs_token1")
+	// personal accounts are looked up after orgs
+	assertAuthorization(repoAuth, map[string]string{"owner": "octocat", "repo": "hello-world"}, "Bearer ghs_token2")
+	// params can hold owner/repo
+	assertAuthorization(&gitHubAppAuth{source: source, ownerParam: "repo"}, map[string]string{"repo": "acme/widgets"}, "Bearer ghs_token1")
+
+	// tokens are refreshed before they expire
+	if _, err := source.installationToken(context.Background(), http.DefaultTransport, "acme", time.Now().Add(56*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if tokensCreated != 3 {
+		t.Errorf("expected a new token close to expiry, %v tokens were created", tokensCreated)
+	}
+
+	// app endpoints get the JWT
+	headers, err := (&gitHubAppAuth{source: source}).authHeaders(context.Background(), nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyGitHubAppJWT(t, key, headers["Authorization"])
+
+	if _, err := repoAuth.authHeaders(context.Background(), map[string]string{"owner": "unknown"}, http.DefaultTransport); err == nil {
+		t.Error("expected an error for an account without the app installed")
+	}
+}
+
+func TestGitHubAppPresetDoesNotMintTokensForSemgrep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	contents := "inbound:\n  github:\n    baseUrl: https://github.example.com/api/v3\n    app:\n      appId: 1234\n      privateKey: ${env:GITHUB_APP_KEY}\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig([]string{path}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticated := map[string]bool{}
+	for _, item := range config.Inbound.Allowlist {
+		authenticated[item.URL] = item.authenticator != nil
+	}
+	for _, path := range []string{"/app", "/app/installations/:id/access_tokens"} {
+		if appAuth, exists := authenticated["https://github.example.com/api/v3"+path]; !exists || appAuth {
+			t.Errorf("expected %v to be allowlisted without the app's credentials", path)
+		}
+	}
+	if !authenticated["https://github.example.com/api/v3/orgs/:org/installation"] {
+		t.Errorf("expected installation lookups to be authenticated with the app")
+	}
+}
+
+func TestGitHubAppTokenSourceConcurrency(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	var tokensCreated int64
+	hang := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/orgs/slow/installation":
+			<-hang
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/api/v3/orgs/acme/installation":
+			w.Write([]byte(`{"id": 42}`))
+		case "/api/v3/app/installations/42/access_tokens":
+			n := atomic.AddInt64(&tokensCreated, 1)
+			// give concurrent requests a chance to pile up
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "ghs_token%d", "expires_at": "%v"}`, n, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	// release the hanging request before the server is closed
+	defer close(hang)
+
+	baseUrl, _ := url.Parse(server.URL + "/api/v3")
+	source := newGitHubAppTokenSource(&GitHubApp{AppID: 1234, PrivateKey: SecretString(keyPem)}, baseUrl)
+
+	// a hanging request for one account doesn't hold up other accounts
+	go source.installationToken(context.Background(), http.DefaultTransport, "slow", time.Now())
+	time.Sleep(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = source.installationToken(context.Background(), http.DefaultTransport, "acme", time.Now())
+		}(i)
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests for one account were blocked by another account")
+	}
+
+	// concurrent requests for the same account share one token
+	for _, token := range tokens {
+		if token != "ghs_token1" {
+			t.Errorf("expected every request to get the same token, got %v", tokens)
+			break
+		}
+	}
+	if tokensCreated != 1 {
+		t.Errorf("expected a single token to be created, %v were created", tokensCreated)
+	}
+}
@@ -3,13 +3,28 @@ package pkg
 import (
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
+// heartbeatStatus records when the last heartbeat succeeded, for the readiness check
+type heartbeatStatus struct {
+	lastSuccess atomic.Int64
+}
+
+// lastSuccess returns when the last heartbeat succeeded, or the zero time if none has
+func (config *HeartbeatConfig) lastSuccess() time.Time {
+	if config.status == nil || config.status.lastSuccess.Load() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, config.status.lastSuccess.Load())
+}
+
 func (config *HeartbeatConfig) Start(tnet *netstack.Net, userAgent string) (func(), error) {
+	config.status = &heartbeatStatus{}
 	ticker := time.NewTicker(time.Duration(config.IntervalSeconds) * time.Second)
 	done := make(chan bool)
 	failures := -1
@@ -48,6 +63,7 @@ func (config *HeartbeatConfig) Start(tnet *netstack.Net, userAgent string) (func
 			}
 			log.Debug("heartbeat.success")
 			failures = 0
+			config.status.lastSuccess.Store(time.Now().UnixNano())
 			return true
 		}
 	}
@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// history is stored in one JSONL segment per hour, so queries can skip old segments and retention can delete whole files
+const historySegmentPrefix = "requests-"
+const historySegmentSuffix = ".jsonl"
+const historySegmentTimeFormat = "20060102T15"
+
+const historyQueueSize = 1000
+const historyPruneInterval = time.Minute
+
+func historySegmentName(t time.Time) string {
+	return historySegmentPrefix + t.UTC().Format(historySegmentTimeFormat) + historySegmentSuffix
+}
+
+type historySegment struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// historySegments returns the segments in the directory, oldest first
+func historySegments(directory string) ([]historySegment, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var segments []historySegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, historySegmentPrefix) || !strings.HasSuffix(name, historySegmentSuffix) {
+			continue
+		}
+		start, err := time.Parse(historySegmentTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, historySegmentPrefix), historySegmentSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, historySegment{path: filepath.Join(directory, name), start: start, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	return segments, nil
+}
+
+// RequestHistory keeps request metadata on disk for a bounded time, so that past requests can be queried
+type RequestHistory struct {
+	config  HistoryConfig
+	records chan AuditRecord
+	done    chan struct{}
+
+	// closed is guarded by mu, so that records aren't sent after the channel is closed
+	mu     sync.RWMutex
+	closed bool
+
+	// only used by the writer goroutine
+	file        *os.File
+	writer      *bufio.Writer
+	segmentName string
+}
+
+func (config HistoryConfig) build() (*RequestHistory, error) {
+	if config.Directory == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	history := &RequestHistory{
+		config:  config,
+		records: make(chan AuditRecord, historyQueueSize),
+		done:    make(chan struct{}),
+	}
+	history.prune(time.Now())
+	go history.run()
+
+	log.WithField("directory", config.Directory).Info("history.configured")
+	return history, nil
+}
+
+// Add queues the record to be written. Records are dropped rather than slowing down requests if the writer falls behind.
+func (history *RequestHistory) Add(record AuditRecord) {
+	if history == nil {
+		return
+	}
+	history.mu.RLock()
+	defer history.mu.RUnlock()
+	if history.closed {
+		return
+	}
+	select {
+	case history.records <- record:
+	default:
+		log.WithField("destination", record.Destination).Warn("history.dropped")
+	}
+}
+
+// Close writes any queued records and stops the writer. Records added after this are dropped.
+func (history *RequestHistory) Close() {
+	if history == nil {
+		return
+	}
+	history.mu.Lock()
+	if !history.closed {
+		history.closed = true
+		close(history.records)
+	}
+	history.mu.Unlock()
+	<-history.done
+}
+
+func (history *RequestHistory) run() {
+	defer close(history.done)
+
+	ticker := time.NewTicker(historyPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case record, ok := <-history.records:
+			if !ok {
+				history.closeSegment()
+				return
+			}
+			if err := history.write(record); err != nil {
+				log.WithError(err).Error("history.write_error")
+			}
+			// batch writes while requests are queued
+			if len(history.records) == 0 && history.writer != nil {
+				history.writer.Flush()
+			}
+		case now := <-ticker.C:
+			history.prune(now)
+		}
+	}
+}
+
+func (history *RequestHistory) closeSegment() {
+	if history.file != nil {
+		history.writer.Flush()
+		history.file.Close()
+		history.file = nil
+	}
+}
+
+func (history *RequestHistory) write(record AuditRecord) error {
+	// records are filed by when the request started, which for long requests may be in an earlier segment
+	segmentName := historySegmentName(record.Time)
+	if history.file == nil || segmentName != history.segmentName {
+		history.closeSegment()
+		file, err := os.OpenFile(filepath.Join(history.config.Directory, segmentName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		history.file = file
+		history.writer = bufio.NewWriter(file)
+		history.segmentName = segmentName
+	}
+
+	// the hash chain is only meaningful in the audit log
+	record.PrevHash = ""
+	record.Hash = ""
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = history.writer.Write(append(line, '\n'))
+	return err
+}
+
+// prune deletes segments older than the max age, then the oldest segments until the history fits in the max size
+func (history *RequestHistory) prune(now time.Time) {
+	segments, err := historySegments(history.config.Directory)
+	if err != nil {
+		log.WithError(err).Error("history.prune_error")
+		return
+	}
+
+	var totalBytes int64
+	for _, segment := range segments {
+		totalBytes += segment.size
+	}
+
+	cutoff := now.Add(-time.Duration(history.config.MaxAgeHours) * time.Hour)
+	for _, segment := range segments {
+		expired := history.config.MaxAgeHours > 0 && segment.start.Add(time.Hour).Before(cutoff)
+		tooBig := history.config.MaxBytes > 0 && totalBytes > history.config.MaxBytes
+		// never delete the segment being written
+		if (!expired && !tooBig) || filepath.Base(segment.path) == history.segmentName {
+			continue
+		}
+		if err := os.Remove(segment.path); err != nil {
+			log.WithError(err).Error("history.prune_error")
+			continue
+		}
+		totalBytes -= segment.size
+		log.WithField("segment", filepath.Base(segment.path)).Info("history.pruned")
+	}
+}
+
+// HistoryQuery filters history records. Zero values match everything.
+type HistoryQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Host     string
+	Status   int
+	Method   string
+	Path     string
+	Decision string
+}
+
+func (query HistoryQuery) matches(record AuditRecord) bool {
+	if !query.Since.IsZero() && record.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !record.Time.Before(query.Until) {
+		return false
+	}
+	if query.Status != 0 && record.Status != query.Status {
+		return false
+	}
+	if query.Method != "" && !strings.EqualFold(record.Method, query.Method) {
+		return false
+	}
+	if query.Decision != "" && record.Decision != query.Decision {
+		return false
+	}
+	if query.Host == "" && query.Path == "" {
+		return true
+	}
+	destination, err := url.Parse(record.Destination)
+	if err != nil {
+		return false
+	}
+	if query.Host != "" && !hostMatchesPatterns([]string{strings.ToLower(query.Host)}, strings.ToLower(destination.Host), strings.ToLower(destination.Hostname())) {
+		return false
+	}
+	return query.Path == "" || strings.Contains(destination.Path, query.Path)
+}
+
+// QueryHistory returns the records in the history directory that match the query
+func QueryHistory(directory string, query HistoryQuery) ([]AuditRecord, error) {
+	segments, err := historySegments(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+
+	var records []AuditRecord
+	for _, segment := range segments {
+		if !query.Since.IsZero() && !segment.start.Add(time.Hour).After(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && !segment.start.Before(query.Until) {
+			continue
+		}
+
+		file, err := os.Open(segment.path)
+		if err != nil {
+			// the segment may have just been pruned
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64<<10), auditTailBytes)
+		for scanner.Scan() {
+			record := AuditRecord{}
+			if json.Unmarshal(scanner.Bytes(), &record) != nil {
+				continue
+			}
+			if query.matches(record) {
+				records = append(records, record)
+			}
+		}
+		file.Close()
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequestHistoryQuery(t *testing.T) {
+	config := HistoryConfig{Directory: t.TempDir()}
+	history, err := config.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	history.Add(AuditRecord{Time: now.Add(-48 * time.Hour), Decision: AuditAllowed, Method: "GET", Destination: "https://gitlab.internal/api/v4/projects/1/repository/files/secrets.yaml", Status: 200})
+	history.Add(AuditRecord{Time: now.Add(-2 * time.Hour), Decision: AuditAllowed, Method: "GET", Destination: "https://gitlab.internal/api/v4/projects/1/repository/files/main.go", Status: 200})
+	history.Add(AuditRecord{Time: now.Add(-time.Hour), Decision: AuditDenied, Reason: "allowlist", Method: "DELETE", Destination: "https://gitlab.internal/api/v4/projects/1", Status: 403})
+	history.Add(AuditRecord{Time: now, Decision: AuditAllowed, Method: "POST", Destination: "https://api.github.com/repos/acme/widgets/issues/1/comments", Status: 201})
+	history.Close()
+
+	tests := []struct {
+		name     string
+		query    HistoryQuery
+		expected int
+	}{
+		{"all", HistoryQuery{}, 4},
+		{"since", HistoryQuery{Since: now.Add(-24 * time.Hour)}, 3},
+		{"until", HistoryQuery{Until: now.Add(-24 * time.Hour)}, 1},
+		{"host", HistoryQuery{Host: "gitlab.internal"}, 3},
+		{"host glob", HistoryQuery{Host: "*.github.com"}, 1},
+		{"status", HistoryQuery{Since: now.Add(-24 * time.Hour), Host: "gitlab.internal", Status: 403}, 1},
+		{"path", HistoryQuery{Path: "/files/secrets.yaml"}, 1},
+		{"decision", HistoryQuery{Decision: AuditAllowed, Method: "get"}, 2},
+	}
+	for _, test := range tests {
+		records, err := QueryHistory(config.Directory, test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != test.expected {
+			t.Errorf("%v: expected %d records, got %d", test.name, test.expected, len(records))
+		}
+	}
+}
+
+func TestInboundProxyCloseHistory(t *testing.T) {
+	history, err := HistoryConfig{Directory: t.TempDir()}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &InboundProxyConfig{history: history}
+	history.Add(AuditRecord{Time: time.Now(), Decision: AuditAllowed, Method: "GET", Destination: "https://gitlab.internal/api/v4/projects/1", Status: 200})
+	if err := config.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := QueryHistory(history.config.Directory, HistoryQuery{})
+	if err != nil || len(records) != 1 {
+		t.Errorf("expected the queued record to be written on close, got %v %v", records, err)
+	}
+
+	// requests that are still in flight when the broker shuts down don't panic
+	history.Add(AuditRecord{Time: time.Now(), Decision: AuditAllowed, Method: "GET", Destination: "https://gitlab.internal/api/v4/projects/1", Status: 200})
+	config.Close()
+}
+
+func TestRequestHistoryRetention(t *testing.T) {
+	directory := t.TempDir()
+	now := time.Now()
+	for _, age := range []time.Duration{72 * time.Hour, 3 * time.Hour, 2 * time.Hour, 0} {
+		os.WriteFile(filepath.Join(directory, historySegmentName(now.Add(-age))), make([]byte, 100), 0600)
+	}
+
+	history := &RequestHistory{config: HistoryConfig{Directory: directory, MaxAgeHours: 24, MaxBytes: 250}}
+	history.prune(now)
+
+	segments, _ := historySegments(directory)
+	// the 72h old segment has expired, and the 3h old one is removed to fit in 250 bytes
+	if len(segments) != 2 || segments[0].path != filepath.Join(directory, historySegmentName(now.Add(-2*time.Hour))) {
+		t.Errorf("unexpected segments after pruning: %+v", segments)
+	}
+}
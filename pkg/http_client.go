@@ -1,52 +1,222 @@
 package pkg
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
 )
 
-func (hcc *HttpClientConfig) BuildRoundTripper() (http.RoundTripper, error) {
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
-	transport := &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           dialer.DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+func (profile TLSProfile) Validate() error {
+	if _, exists := tlsVersions[profile.MinVersion]; profile.MinVersion != "" && !exists {
+		return fmt.Errorf("tls profile %v: unknown minVersion %v (expected 1.0, 1.1, 1.2 or 1.3)", profile.Name, profile.MinVersion)
+	}
+	if (profile.ClientCert == "") != (profile.ClientKey == "") {
+		return fmt.Errorf("tls profile %v: clientCert and clientKey must be set together", profile.Name)
+	}
+	if err := validateHostPatterns(profile.Hosts); err != nil {
+		return fmt.Errorf("tls profile %v: %v", profile.Name, err)
+	}
+	for _, pin := range profile.PinnedSPKISHA256 {
+		if decoded, err := base64.StdEncoding.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("tls profile %v: pinned SPKI hash %v is not a base64-encoded SHA-256 hash", profile.Name, pin)
+		}
 	}
+	return nil
+}
 
-	if len(hcc.AdditionalCACerts) > 0 {
-		certPool, err := x509.SystemCertPool()
-		if err != nil {
-			return nil, err
+func (hcc HttpClientConfig) Validate() error {
+	names := map[string]bool{}
+	for _, profile := range hcc.TLSProfiles {
+		if names[profile.Name] {
+			return fmt.Errorf("duplicate tls profile name: %v", profile.Name)
 		}
+		names[profile.Name] = true
+	}
+	return nil
+}
 
-		for i := range hcc.AdditionalCACerts {
-			caCert, err := os.ReadFile(hcc.AdditionalCACerts[i])
+func buildCertPool(caCertFiles ...[]string) (*x509.CertPool, error) {
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, files := range caCertFiles {
+		for i := range files {
+			caCert, err := os.ReadFile(files[i])
 			if err != nil {
 				return nil, fmt.Errorf("failed to add CA cert to pool: %v", err)
 			}
 
 			if ok := certPool.AppendCertsFromPEM(caCert); !ok {
-				return nil, fmt.Errorf("failed to add CA cert to pool: %v", hcc.AdditionalCACerts[i])
+				return nil, fmt.Errorf("failed to add CA cert to pool: %v", files[i])
+			}
+		}
+	}
+
+	return certPool, nil
+}
+
+// verifyPinnedSPKI returns a VerifyConnection func that requires one of the certificates in a verified chain to have a
+// pinned public key. Certificates the server presents that aren't part of a verified chain don't count.
+func verifyPinnedSPKI(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if stringInSlice(base64.StdEncoding.EncodeToString(hash[:]), pins) {
+					return nil
+				}
 			}
 		}
-		transport.TLSClientConfig = &tls.Config{
-			ClientCAs:  certPool,
-			MinVersion: tls.VersionTLS13,
+		return fmt.Errorf("no certificate presented by %v matches a pinned public key", cs.ServerName)
+	}
+}
+
+func (hcc *HttpClientConfig) buildTLSConfig(profile *TLSProfile) (*tls.Config, error) {
+	if len(hcc.AdditionalCACerts) == 0 && profile == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if profile == nil {
+		certPool, err := buildCertPool(hcc.AdditionalCACerts)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = certPool
+		return tlsConfig, nil
+	}
+
+	certPool, err := buildCertPool(hcc.AdditionalCACerts, profile.CACerts)
+	if err != nil {
+		return nil, fmt.Errorf("tls profile %v: %v", profile.Name, err)
+	}
+	tlsConfig.RootCAs = certPool
+	tlsConfig.MinVersion = tlsVersions[profile.MinVersion]
+	tlsConfig.ServerName = profile.ServerName
+
+	if profile.ClientCert != "" {
+		clientCert, err := tls.LoadX509KeyPair(profile.ClientCert, profile.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls profile %v: failed to load client certificate: %v", profile.Name, err)
 		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if len(profile.PinnedSPKISHA256) > 0 {
+		tlsConfig.VerifyConnection = verifyPinnedSPKI(profile.PinnedSPKISHA256)
+	}
+
+	return tlsConfig, nil
+}
+
+func (hcc *HttpClientConfig) buildTransport(profile *TLSProfile, proxy func(*http.Request) (*url.URL, error)) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                  proxy,
+		OnProxyConnectResponse: checkProxyConnectResponse,
+		DialContext:            dialer.DialContext,
+		ForceAttemptHTTP2:      true,
+		MaxIdleConns:           100,
+		IdleConnTimeout:        90 * time.Second,
+		TLSHandshakeTimeout:    10 * time.Second,
+		ExpectContinueTimeout:  1 * time.Second,
+	}
+
+	tlsConfig, err := hcc.buildTLSConfig(profile)
+	if err != nil {
+		return nil, err
 	}
+	transport.TLSClientConfig = tlsConfig
 
 	return transport, nil
 }
+
+// HttpTransports holds a transport for each TLS profile, plus a default transport for everything else
+type HttpTransports struct {
+	defaultTransport *http.Transport
+	profiles         []*TLSProfile
+	transports       map[string]*http.Transport
+}
+
+func (hcc *HttpClientConfig) BuildTransports() (*HttpTransports, error) {
+	proxy, err := hcc.Proxy.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultTransport, err := hcc.buildTransport(nil, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transports := &HttpTransports{
+		defaultTransport: defaultTransport,
+		transports:       map[string]*http.Transport{},
+	}
+
+	for i := range hcc.TLSProfiles {
+		profile := &hcc.TLSProfiles[i]
+		transport, err := hcc.buildTransport(profile, proxy)
+		if err != nil {
+			return nil, err
+		}
+		transports.profiles = append(transports.profiles, profile)
+		transports.transports[profile.Name] = transport
+	}
+
+	return transports, nil
+}
+
+func (transports *HttpTransports) HasProfile(name string) bool {
+	_, exists := transports.transports[name]
+	return exists
+}
+
+// Get returns the transport for the named profile if set, otherwise the first profile matching the destination host, otherwise the default transport
+func (transports *HttpTransports) Get(profileName string, destinationUrl *url.URL) http.RoundTripper {
+	if transport, exists := transports.transports[profileName]; exists {
+		return transport
+	}
+
+	for _, profile := range transports.profiles {
+		if hostMatchesPatterns(profile.Hosts, destinationUrl.Host, destinationUrl.Hostname()) {
+			return transports.transports[profile.Name]
+		}
+	}
+
+	return transports.defaultTransport
+}
+
+// CloseIdleConnections closes the idle connections of every transport, e.g. once they've been replaced by a reload
+func (transports *HttpTransports) CloseIdleConnections() {
+	transports.defaultTransport.CloseIdleConnections()
+	for _, transport := range transports.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// RoundTrip sends the request using the transport for the request's host
+func (transports *HttpTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	return transports.Get("", req.URL).RoundTrip(req)
+}
@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func assertTransportStatus(t *testing.T, transport http.RoundTripper, target string, expectSuccess bool) {
+	req, _ := http.NewRequest("GET", target, nil)
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if expectSuccess && err != nil {
+		t.Errorf("request to %v failed: %v", target, err)
+	}
+	if !expectSuccess && err == nil {
+		t.Errorf("request to %v should have failed", target)
+	}
+}
+
+func TestHttpTransportsTLSProfiles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := writeServerCA(t, server)
+	spkiHash := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	wrongHash := sha256.Sum256([]byte("wrong"))
+
+	config := HttpClientConfig{
+		TLSProfiles: []TLSProfile{
+			{Name: "internal", Hosts: []string{"127.0.0.1"}, CACerts: []string{caFile}, MinVersion: "1.2"},
+			{Name: "pinned", CACerts: []string{caFile}, PinnedSPKISHA256: []string{base64.StdEncoding.EncodeToString(spkiHash[:])}},
+			{Name: "wrong-pin", CACerts: []string{caFile}, PinnedSPKISHA256: []string{base64.StdEncoding.EncodeToString(wrongHash[:])}},
+		},
+	}
+	transports, err := config.BuildTransports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverUrl, _ := url.Parse(server.URL)
+	otherUrl, _ := url.Parse("https://localhost")
+
+	if transports.Get("", serverUrl) != transports.transports["internal"] {
+		t.Error("expected the host-matched profile to be selected")
+	}
+	if transports.Get("pinned", serverUrl) != transports.transports["pinned"] {
+		t.Error("expected the named profile to take precedence over host matching")
+	}
+	if transports.Get("", otherUrl) != transports.defaultTransport {
+		t.Error("expected the default transport for unmatched hosts")
+	}
+
+	assertTransportStatus(t, transports.defaultTransport, server.URL, false)
+	assertTransportStatus(t, transports, server.URL, true)
+	assertTransportStatus(t, transports.Get("pinned", serverUrl), server.URL, true)
+	assertTransportStatus(t, transports.Get("wrong-pin", serverUrl), server.URL, false)
+}
+
+func TestPinnedSPKIIgnoresUnverifiedCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pinned.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server presents a valid chain that's unrelated to the pinned cert, with the pinned cert appended
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	server.TLS.Certificates[0].Certificate = append(server.TLS.Certificates[0].Certificate, der)
+
+	pinnedHash := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	config := HttpClientConfig{
+		TLSProfiles: []TLSProfile{
+			{Name: "pinned", CACerts: []string{writeServerCA(t, server)}, PinnedSPKISHA256: []string{base64.StdEncoding.EncodeToString(pinnedHash[:])}},
+		},
+	}
+	transports, err := config.BuildTransports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverUrl, _ := url.Parse(server.URL)
+	assertTransportStatus(t, transports.Get("pinned", serverUrl), server.URL, false)
+}
+
+func TestTLSProfileValidate(t *testing.T) {
+	invalidProfiles := []TLSProfile{
+		{Name: "a", MinVersion: "1.4"},
+		{Name: "a", ClientCert: "cert.pem"},
+		{Name: "a", Hosts: []string{"[bad"}},
+		{Name: "a", PinnedSPKISHA256: []string{"not-a-hash"}},
+	}
+	for _, profile := range invalidProfiles {
+		if err := profile.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", profile)
+		}
+	}
+
+	if err := (HttpClientConfig{TLSProfiles: []TLSProfile{{Name: "a"}, {Name: "a"}}}).Validate(); err == nil {
+		t.Error("expected duplicate profile names to be invalid")
+	}
+}
@@ -1,17 +1,18 @@
 package pkg
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	ginprometheus "github.com/zsais/go-gin-prometheus"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 	"gopkg.in/dealancer/validate.v2"
 )
@@ -28,11 +29,39 @@ func (config *InboundProxyConfig) Start(tnet *netstack.Net) error {
 		return fmt.Errorf("invalid inbound config: %v", err)
 	}
 
-	// build http transport (needed for custom CA certs, etc...)
-	transport, err := config.HttpClient.BuildRoundTripper()
+	// build the allowlist, logging, http client and cache state, which can be replaced later by reloading the config
+	initialState, err := config.buildState(nil)
 	if err != nil {
 		return err
 	}
+	config.state = &atomic.Pointer[inboundProxyState]{}
+	config.state.Store(initialState)
+
+	// setup global rate limiter
+	var globalRateLimiter *rateLimiter
+	if config.RateLimit != nil {
+		globalRateLimiter = newRateLimiter(globalRateLimitName, config.RateLimit)
+	}
+
+	// setup concurrency limits
+	concurrency := config.Concurrency.build()
+
+	// setup circuit breakers
+	breakers := config.CircuitBreaker.build()
+
+	// setup audit log
+	auditLog, err := config.Audit.build()
+	if err != nil {
+		return err
+	}
+	config.auditLog = auditLog
+
+	// setup request history
+	history, err := config.History.build()
+	if err != nil {
+		return err
+	}
+	config.history = history
 
 	// setup http server
 	gin.SetMode(gin.ReleaseMode)
@@ -42,61 +71,201 @@ func (config *InboundProxyConfig) Start(tnet *netstack.Net) error {
 	r.UseRawPath = true
 	r.UnescapePathValues = false
 
-	r.Use(LoggerWithConfig(log.StandardLogger(), config.Logging.SkipPaths), gin.Recovery())
+	r.Use(LoggerWithSkip(log.StandardLogger(), func(path string) bool {
+		return config.state.Load().skipPaths[path]
+	}, func(rawQuery string) string {
+		return config.state.Load().redactor.redactQuery(rawQuery)
+	}), gin.Recovery())
 
 	// setup healthcheck
-	r.GET(healthcheckPath, func(c *gin.Context) { c.JSON(http.StatusOK, "OK") })
+	r.GET(healthcheckPath, func(c *gin.Context) {
+		if breakers == nil {
+			c.JSON(http.StatusOK, "OK")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "OK", "circuitBreakers": breakers.states()})
+	})
 	log.WithField("path", healthcheckPath).Info("healthcheck.configured")
 
+	// setup liveness and readiness endpoints, which are only served outside of the tunnel
+	readiness := &readinessChecker{config: config.Health, heartbeat: &config.Heartbeat, wireguard: &config.Wireguard}
+	config.readiness = readiness
+	if err := readiness.listen(); err != nil {
+		return err
+	}
+
 	// setup metrics
-	p := ginprometheus.NewPrometheus("gin")
-	p.Use(r)
-	log.WithField("path", p.MetricsPath).Info("metrics.configured")
+	config.Metrics.setup(r)
 
 	// setup http proxy
 	r.Any(proxyPath, func(c *gin.Context) {
+		start := time.Now()
 		logger := log.WithFields(GetRequestFields(c))
+		// use the same config for the whole request, even if it's reloaded
+		state := config.state.Load()
+		logging := state.config.Logging
+
+		// record every decision, whether or not the request is proxied
+		auditRecord := &AuditRecord{Decision: AuditDenied, Method: c.Request.Method, Destination: c.Param(destinationUrlParam)[1:]}
+		// only set once the request matches the allowlist, so that denied requests can't create arbitrary metric series
+		var metricsHost string
+		requestBody := &countingReadCloser{ReadCloser: c.Request.Body}
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			c.Request.Body = requestBody
+		}
+		defer func() {
+			auditRecord.Time = start.UTC()
+			auditRecord.Status = c.Writer.Status()
+			auditRecord.RequestBytes = requestBody.count.Load()
+			auditRecord.ResponseBytes = max(int64(c.Writer.Size()), 0)
+			auditRecord.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+			if err := auditLog.Write(auditRecord); err != nil {
+				logger.WithError(err).Error("audit.write_error")
+			}
+			history.Add(*auditRecord)
+
+			decision := auditRecord.Decision
+			if decision == AuditAllowed && auditRecord.Reason != "" {
+				decision = "error"
+			}
+			labels := []string{auditRecord.AllowlistMatch, c.Request.Method, metricsHost, decision}
+			proxyRequestsCounter.WithLabelValues(append(labels, statusClass(auditRecord.Status))...).Inc()
+			proxyRequestBytesCounter.WithLabelValues(labels...).Add(float64(auditRecord.RequestBytes))
+			proxyResponseBytesCounter.WithLabelValues(labels...).Add(float64(auditRecord.ResponseBytes))
+		}()
+
 		destinationUrl, err := url.Parse(c.Param(destinationUrlParam)[1:])
 
 		// we have to explicitly copy over the query params
 		destinationUrl.RawQuery = c.Request.URL.RawQuery
 
-		logger = logger.WithField("destinationUrl", destinationUrl)
+		logger = logger.WithField("destinationUrl", state.redactor.redactURL(destinationUrl))
 
 		if err != nil {
 			logger.WithError(err).Warn("proxy.destination_url_parse")
+			auditRecord.Reason = "invalid_url"
 			c.Header(errorResponseHeader, "1")
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		allowlistMatch, exists := config.Allowlist.FindMatch(c.Request.Method, destinationUrl)
+		auditRecord.Destination = state.redactor.redactURL(destinationUrl)
+
+		// deny rules always take precedence over the allowlist
+		denylistMatch, denied := state.denylist.FindMatch(c.Request.Method, destinationUrl)
+		if denied {
+			denyLogger := logger.WithField("denylist_match", denylistMatch.URL)
+			if len(denylistMatch.Params) > 0 {
+				denyLogger = denyLogger.WithField("denylist_params", denylistMatch.Params)
+			}
+			denyLogger.Warn("denylist.reject")
+			auditRecord.Reason = "denylist"
+			c.Header(errorResponseHeader, "1")
+			c.JSON(http.StatusForbidden, gin.H{"error": "url is in denylist"})
+			return
+		}
+
+		allowlistMatch, exists := state.allowlist.FindMatch(c.Request.Method, destinationUrl)
 		if !exists {
 			logger.Warn("allowlist.reject")
+			auditRecord.Reason = "allowlist"
 			c.Header(errorResponseHeader, "1")
 			c.JSON(http.StatusForbidden, gin.H{"error": "url is not in allowlist"})
 			return
 		}
 
 		logger = logger.WithField("allowlist_match", allowlistMatch.URL)
+		auditRecord.AllowlistMatch = allowlistMatch.URL
+		metricsHost = strings.ToLower(destinationUrl.Hostname())
+		if len(allowlistMatch.Params) > 0 {
+			logger = logger.WithField("allowlist_params", allowlistMatch.Params)
+		}
+
+		rateLimit := checkRateLimits(time.Now(), allowlistMatch.Params, globalRateLimiter, state.itemRateLimiters[allowlistMatch.AllowlistItem])
+		if !rateLimit.allowed {
+			logger.WithField("limit", rateLimit.limit).WithField("retry_after", rateLimit.retryAfter).Warn("ratelimit.reject")
+			auditRecord.Reason = "rate_limit"
+			c.Header(errorResponseHeader, "1")
+			c.Header("Retry-After", fmt.Sprint(retryAfterSeconds(rateLimit.retryAfter)))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+
+		if allowlistMatch.bodyPolicy != nil {
+			if err := allowlistMatch.bodyPolicy.ReadAndCheck(c.Request); err != nil {
+				statusCode := http.StatusBadRequest
+				if violation, ok := err.(*BodyPolicyViolation); ok {
+					statusCode = violation.StatusCode
+				}
+				logger.WithError(err).Warn("allowlist.body_reject")
+				auditRecord.Reason = "body_policy"
+				c.Header(errorResponseHeader, "1")
+				c.JSON(statusCode, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		release, err := concurrency.acquire(c.Request.Context(), destinationUrl.Host, destinationUrl.Hostname())
+		if err != nil {
+			logger.WithError(err).Warn("concurrency.reject")
+			auditRecord.Reason = "concurrency"
+			c.Header(errorResponseHeader, "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		defer release()
+
+		transport := state.transports.Get(allowlistMatch.TLSProfile, destinationUrl)
+
+		// resolve injected credentials now, so the latest values are used
+		setRequestHeaders, err := ResolveSecretHeaders(allowlistMatch.SetRequestHeaders)
+		var authHeaders map[string]string
+		if err == nil && allowlistMatch.authenticator != nil {
+			authHeaders, err = allowlistMatch.authenticator.authHeaders(c.Request.Context(), allowlistMatch.Params, transport)
+			for headerName, headerValue := range authHeaders {
+				setRequestHeaders[headerName] = headerValue
+			}
+		}
+		if err != nil {
+			logger.WithError(err).Warn("proxy.credentials_error")
+			auditRecord.Reason = "credentials"
+			c.Header(errorResponseHeader, "1")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve credentials for destination"})
+			return
+		}
 
 		reqLogger := logger
-		if config.Logging.LogRequestBody || allowlistMatch.LogRequestBody {
-			reqBody := &bytes.Buffer{}
-			reqBody.ReadFrom(c.Request.Body)
-			defer c.Request.Body.Close()
-			c.Request.Body = io.NopCloser(reqBody)
-			reqLogger = reqLogger.WithField("request_body", reqBody.String())
+		if logging.LogRequestHeaders || allowlistMatch.LogRequestHeaders {
+			reqLogger = reqLogger.WithField("request_headers", state.redactor.redactHeaders(c.Request.Header))
 		}
 
-		if config.Logging.LogRequestHeaders || allowlistMatch.LogRequestHeaders {
-			reqLogger = reqLogger.WithField("request_headers", c.Request.Header)
+		if !(logging.LogRequestBody || allowlistMatch.LogRequestBody) {
+			reqLogger.Info("proxy.request")
+		} else if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			reqLogger.WithField("request_body", "").Info("proxy.request")
+		} else {
+			// the request is logged once its body has been sent upstream, so that the body doesn't need to be buffered
+			requestCapture := newBodyCapture(c.Request.Body, logging.MaxBodyBytes, func(captured []byte, totalBytes int64) {
+				reqLogger.WithField("request_body", state.redactor.redactBody(captured, totalBytes)).Info("proxy.request")
+			})
+			c.Request.Body = requestCapture
+			// in case the request fails before its body is sent
+			defer requestCapture.finish()
 		}
 
-		reqLogger.Info("proxy.request")
+		retryConfig := &config.Retry
+		if allowlistMatch.Retry != nil {
+			retryConfig = allowlistMatch.Retry
+		}
+
+		// signing comes after every other layer that sets headers, so that each attempt is signed as it's sent
+		upstreamTransport := &upstreamMetricsRoundTripper{transport: transport, allowlist: allowlistMatch.URL}
+		proxyTransport := newSigningRoundTripper(breakers.wrap(upstreamTransport), allowlistMatch.Signing)
+		proxyTransport = state.cache.wrap(newRetryRoundTripper(proxyTransport, retryConfig, logger), allowlistMatch.AllowlistItem)
+		proxyTransport = newReauthRoundTripper(proxyTransport, allowlistMatch.authenticator, allowlistMatch.Params, authHeaders, transport, logger)
 
 		proxy := httputil.ReverseProxy{
-			Transport: transport,
+			Transport: proxyTransport,
 			Director: func(req *http.Request) {
 				req.URL = destinationUrl
 				req.Host = destinationUrl.Host
@@ -108,7 +277,7 @@ func (config *InboundProxyConfig) Start(tnet *netstack.Net) error {
 						req.SetBasicAuth(destinationUrl.User.Username(), "")
 					}
 				}
-				for headerName, headerValue := range allowlistMatch.SetRequestHeaders {
+				for headerName, headerValue := range setRequestHeaders {
 					req.Header.Set(headerName, headerValue)
 				}
 			},
@@ -118,20 +287,45 @@ func (config *InboundProxyConfig) Start(tnet *netstack.Net) error {
 					resp.Header.Del(headerToRemove)
 				}
 				respLogger := logger
-				if config.Logging.LogResponseBody || allowlistMatch.LogResponseBody {
-					respBuf := &bytes.Buffer{}
-					respBuf.ReadFrom(resp.Body)
-					defer resp.Body.Close()
-					resp.Body = io.NopCloser(respBuf)
-					respLogger = logger.WithField("response_body", respBuf.String())
+				if logging.LogResponseHeaders || allowlistMatch.LogResponseHeaders {
+					respLogger = respLogger.WithField("response_headers", state.redactor.redactHeaders(resp.Header))
 				}
-				if config.Logging.LogResponseHeaders || allowlistMatch.LogResponseHeaders {
-					respLogger = respLogger.WithField("response_headers", resp.Header)
+				if logging.LogResponseBody || allowlistMatch.LogResponseBody {
+					// the response is logged once its body has been streamed to the client
+					resp.Body = newBodyCapture(resp.Body, logging.MaxBodyBytes, func(captured []byte, totalBytes int64) {
+						respLogger.WithField("response_body", state.redactor.redactBody(captured, totalBytes)).Info("proxy.response")
+					})
+				} else {
+					respLogger.Info("proxy.response")
 				}
-				respLogger.Info("proxy.response")
 				return nil
 			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				// distinguish a broken forward proxy from a broken destination
+				statusCode := http.StatusBadGateway
+				code := "upstream_error"
+				var circuitOpenErr *CircuitOpenError
+				var signingErr *SigningError
+				var tooLargeErr *SigningBodyTooLargeError
+				if errors.As(err, &circuitOpenErr) {
+					statusCode = http.StatusServiceUnavailable
+					code = "circuit_open"
+				} else if errors.As(err, &tooLargeErr) {
+					statusCode = http.StatusRequestEntityTooLarge
+					code = "request_too_large"
+				} else if errors.As(err, &signingErr) {
+					statusCode = http.StatusInternalServerError
+					code = "signing_error"
+				} else if IsForwardProxyError(err) {
+					code = "forward_proxy_error"
+				}
+				logger.WithError(err).WithField("code", code).Warn("proxy.error")
+				auditRecord.Reason = code
+				c.Header(errorResponseHeader, "1")
+				c.JSON(statusCode, gin.H{"error": err.Error(), "code": code})
+			},
 		}
+		auditRecord.Decision = AuditAllowed
 		proxy.ServeHTTP(c.Writer, c.Request)
 	})
 
@@ -142,7 +336,9 @@ func (config *InboundProxyConfig) Start(tnet *netstack.Net) error {
 			log.Panic(fmt.Errorf("failed to start TCP listener: %v", err))
 		}
 
+		readiness.listening.Store(true)
 		err = r.RunListener(wireguardListener)
+		readiness.listening.Store(false)
 		if err != nil {
 			log.Panic(fmt.Errorf("failed to start http server: %v", err))
 		}
@@ -152,3 +348,9 @@ func (config *InboundProxyConfig) Start(tnet *netstack.Net) error {
 
 	return nil
 }
+
+// Close flushes and closes the audit log and request history. Requests that are still in flight aren't recorded after this.
+func (config *InboundProxyConfig) Close() error {
+	config.history.Close()
+	return config.auditLog.Close()
+}
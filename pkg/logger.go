@@ -30,6 +30,15 @@ func LoggerWithConfig(logger *log.Logger, notlogged []string) gin.HandlerFunc {
 		}
 	}
 
+	return LoggerWithSkip(logger, func(path string) bool {
+		_, shouldSkip := skip[path]
+		return shouldSkip
+	}, nil)
+}
+
+// LoggerWithSkip is like LoggerWithConfig, but decides whether to skip logging a path on every request, so the paths can change.
+// If redactQuery is set, the logged query string is passed through it.
+func LoggerWithSkip(logger *log.Logger, skip func(path string) bool, redactQuery func(rawQuery string) string) gin.HandlerFunc {
 	var reqIdCounter uint64
 
 	return func(c *gin.Context) {
@@ -37,6 +46,9 @@ func LoggerWithConfig(logger *log.Logger, notlogged []string) gin.HandlerFunc {
 		start := time.Now()
 		path := c.Request.URL.Path
 		raw := c.Request.URL.RawQuery
+		if redactQuery != nil {
+			raw = redactQuery(raw)
+		}
 
 		reqId := atomic.AddUint64(&reqIdCounter, 1)
 
@@ -52,7 +64,7 @@ func LoggerWithConfig(logger *log.Logger, notlogged []string) gin.HandlerFunc {
 		requestLogger := logger.WithFields(fields)
 		c.Set("fields", fields)
 
-		_, shouldSkip := skip[path]
+		shouldSkip := skip(path)
 
 		if !shouldSkip {
 			requestLogger.Info("request.start")
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	ginprometheus "github.com/zsais/go-gin-prometheus"
+)
+
+const metricsNamespace = "semgrep_network_broker"
+
+var rateLimitExceededCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "rate_limit_exceeded_total",
+	Help:      "Number of proxy requests rejected by a rate limit",
+}, []string{"limit"})
+
+var concurrencyInFlightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "concurrency_in_flight",
+	Help:      "Number of proxy requests currently holding a concurrency slot",
+}, []string{"scope"})
+
+var concurrencyQueueDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "concurrency_queue_depth",
+	Help:      "Number of proxy requests waiting for a concurrency slot",
+}, []string{"scope"})
+
+var concurrencyQueueWaitHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "concurrency_queue_wait_seconds",
+	Help:      "Time proxy requests spent waiting for a concurrency slot",
+	Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30},
+}, []string{"scope"})
+
+var concurrencyRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "concurrency_rejected_total",
+	Help:      "Number of proxy requests rejected because of a concurrency limit",
+}, []string{"scope", "reason"})
+
+var retryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "proxy_retries_total",
+	Help:      "Number of proxy requests retried, by the reason for the retry",
+}, []string{"reason"})
+
+var circuitBreakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "circuit_breaker_state",
+	Help:      "State of the circuit breaker for each destination host (0 = closed, 1 = half-open, 2 = open)",
+}, []string{"host"})
+
+var cacheRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cache_requests_total",
+	Help:      "Number of proxy requests to allowlist items with caching enabled, by cache result",
+}, []string{"result"})
+
+// proxy requests are labeled by the allowlist item they matched rather than by path, so that the number of series
+// stays bounded. host is only set for requests that matched the allowlist.
+var proxyRequestLabels = []string{"allowlist", "method", "host", "decision"}
+
+var proxyRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "proxy_requests_total",
+	Help:      "Number of proxy requests, by decision (allowed, denied or error) and response status class",
+}, append(proxyRequestLabels, "status_class"))
+
+var proxyRequestBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "proxy_request_bytes_total",
+	Help:      "Number of request body bytes received by the proxy",
+}, proxyRequestLabels)
+
+var proxyResponseBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "proxy_response_bytes_total",
+	Help:      "Number of response body bytes sent by the proxy",
+}, proxyRequestLabels)
+
+var upstreamLatencyHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "upstream_latency_seconds",
+	Help:      "Time until upstream response headers were received for each attempt, by upstream status class",
+	Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"allowlist", "method", "host", "status_class"})
+
+const metricsPath = "/metrics"
+
+// setupMetrics serves the metrics endpoint, and optionally records the generic gin request metrics
+func (config MetricsConfig) setup(r *gin.Engine) {
+	if config.GinMetrics {
+		p := ginprometheus.NewPrometheus("gin")
+		// label by route rather than by path, since proxy paths contain the whole destination URL
+		p.ReqCntURLLabelMappingFn = func(c *gin.Context) string {
+			return c.FullPath()
+		}
+		r.Use(p.HandlerFunc())
+	}
+	r.GET(metricsPath, gin.WrapH(promhttp.Handler()))
+	log.WithFields(log.Fields{"path": metricsPath, "gin_metrics": config.GinMetrics}).Info("metrics.configured")
+}
+
+// statusClass returns the class of an HTTP status code, e.g. 2xx
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// upstreamMetricsRoundTripper records the latency of each upstream attempt
+type upstreamMetricsRoundTripper struct {
+	transport http.RoundTripper
+	allowlist string
+}
+
+func (rt *upstreamMetricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.transport.RoundTrip(req)
+	class := "error"
+	if err == nil {
+		class = statusClass(resp.StatusCode)
+	}
+	upstreamLatencyHistogram.WithLabelValues(rt.allowlist, req.Method, strings.ToLower(req.URL.Hostname()), class).Observe(time.Since(start).Seconds())
+	return resp, err
+}
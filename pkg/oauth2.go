@@ -0,0 +1,230 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OAuth2GrantClientCredentials = "client_credentials"
+	OAuth2GrantRefreshToken      = "refresh_token"
+)
+
+var oauth2GrantTypes = []string{OAuth2GrantClientCredentials, OAuth2GrantRefreshToken}
+
+const (
+	OAuth2ClientAuthHeader = "header"
+	OAuth2ClientAuthBody   = "body"
+)
+
+var oauth2ClientAuthStyles = []string{OAuth2ClientAuthHeader, OAuth2ClientAuthBody}
+
+// oauth2TokenRefreshWindow is how long before expiry an access token is replaced
+const oauth2TokenRefreshWindow = time.Minute
+
+const oauth2TokenTimeout = 30 * time.Second
+
+func (config *OAuth2Config) grantType() string {
+	if config.GrantType == "" {
+		return OAuth2GrantClientCredentials
+	}
+	return config.GrantType
+}
+
+func (config *OAuth2Config) clientAuth() string {
+	if config.ClientAuth == "" {
+		return OAuth2ClientAuthHeader
+	}
+	return config.ClientAuth
+}
+
+func (config *OAuth2Config) Validate() error {
+	if config == nil {
+		return nil
+	}
+	tokenUrl, err := url.Parse(config.TokenURL)
+	if err != nil || (tokenUrl.Scheme != "http" && tokenUrl.Scheme != "https") || tokenUrl.Host == "" {
+		return fmt.Errorf("oauth2 tokenUrl %q must be an http or https URL", config.TokenURL)
+	}
+	if !stringInSlice(config.grantType(), oauth2GrantTypes) {
+		return fmt.Errorf("unknown oauth2 grantType %v (expected one of %v)", config.GrantType, oauth2GrantTypes)
+	}
+	if !stringInSlice(config.clientAuth(), oauth2ClientAuthStyles) {
+		return fmt.Errorf("unknown oauth2 clientAuth %v (expected one of %v)", config.ClientAuth, oauth2ClientAuthStyles)
+	}
+	if config.grantType() == OAuth2GrantClientCredentials && config.ClientID == "" {
+		return fmt.Errorf("oauth2 clientId is required for the %v grant", OAuth2GrantClientCredentials)
+	}
+	if config.grantType() == OAuth2GrantRefreshToken && config.RefreshToken == "" {
+		return fmt.Errorf("oauth2 refreshToken is required for the %v grant", OAuth2GrantRefreshToken)
+	}
+	return nil
+}
+
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oauth2TokenSource fetches access tokens from a token endpoint and caches them until shortly before they expire
+type oauth2TokenSource struct {
+	name   string
+	config *OAuth2Config
+
+	// transport is replaced when the source is carried over to a reloaded config
+	transportMu sync.Mutex
+	transport   http.RoundTripper
+
+	mu           sync.Mutex
+	token        string
+	refreshAt    time.Time
+	refreshToken string
+}
+
+func newOAuth2TokenSource(name string, config *OAuth2Config, transport http.RoundTripper) *oauth2TokenSource {
+	registerLiteralSecret(config.ClientSecret)
+	registerLiteralSecret(config.RefreshToken)
+	return &oauth2TokenSource{name: name, config: config, transport: transport}
+}
+
+func (source *oauth2TokenSource) currentTransport() http.RoundTripper {
+	source.transportMu.Lock()
+	defer source.transportMu.Unlock()
+	return source.transport
+}
+
+func (source *oauth2TokenSource) setTransport(transport http.RoundTripper) {
+	source.transportMu.Lock()
+	defer source.transportMu.Unlock()
+	source.transport = transport
+}
+
+// accessToken returns the cached token, fetching a new one if there isn't one or it's close to expiring
+func (source *oauth2TokenSource) accessToken(ctx context.Context, now time.Time) (string, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	// tokens without an expiry are used until the destination rejects them
+	if source.token != "" && (source.refreshAt.IsZero() || now.Before(source.refreshAt)) {
+		return source.token, nil
+	}
+
+	token, err := source.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get oauth2 token for %v: %v", source.name, err)
+	}
+
+	RegisterSecret(token.AccessToken)
+	source.token = token.AccessToken
+	source.refreshAt = time.Time{}
+	if token.ExpiresIn > 0 {
+		lifetime := time.Duration(token.ExpiresIn) * time.Second
+		// short-lived tokens are refreshed halfway through their lifetime instead
+		source.refreshAt = now.Add(lifetime - min(oauth2TokenRefreshWindow, lifetime/2))
+	}
+	if token.RefreshToken != "" {
+		// the token endpoint may rotate refresh tokens
+		RegisterSecret(token.RefreshToken)
+		source.refreshToken = token.RefreshToken
+	}
+
+	log.WithField("credential", source.name).WithField("expires_in", token.ExpiresIn).Info("oauth2.token_refreshed")
+	return source.token, nil
+}
+
+// fetch must be called with the lock held
+func (source *oauth2TokenSource) fetch(ctx context.Context) (*oauth2TokenResponse, error) {
+	form := url.Values{"grant_type": {source.config.grantType()}}
+	if len(source.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(source.config.Scopes, " "))
+	}
+	if source.config.grantType() == OAuth2GrantRefreshToken {
+		refreshToken := source.refreshToken
+		if refreshToken == "" {
+			resolved, err := source.config.RefreshToken.Resolve()
+			if err != nil {
+				return nil, err
+			}
+			refreshToken = resolved
+		}
+		form.Set("refresh_token", refreshToken)
+	}
+
+	clientSecret, err := source.config.ClientSecret.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	if source.config.clientAuth() == OAuth2ClientAuthBody {
+		form.Set("client_id", source.config.ClientID)
+		if clientSecret != "" {
+			form.Set("client_secret", clientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", source.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if source.config.clientAuth() == OAuth2ClientAuthHeader && source.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(source.config.ClientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := (&http.Client{Transport: source.currentTransport(), Timeout: oauth2TokenTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	token := &oauth2TokenResponse{}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, token); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// error and error_description are defined by RFC 6749 and don't contain secrets
+		if token.Error != "" {
+			return nil, fmt.Errorf("token endpoint returned HTTP %v: %v %v", resp.StatusCode, token.Error, token.ErrorDescription)
+		}
+		return nil, fmt.Errorf("token endpoint returned HTTP %v", resp.StatusCode)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access_token")
+	}
+	return token, nil
+}
+
+func (source *oauth2TokenSource) authHeaders(ctx context.Context, params map[string]string, transport http.RoundTripper) (map[string]string, error) {
+	token, err := source.accessToken(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"Authorization": "Bearer " + token}, nil
+}
+
+func (source *oauth2TokenSource) invalidate(headers map[string]string) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	// another request may have already replaced the rejected token
+	if source.token != "" && headers["Authorization"] == "Bearer "+source.token {
+		source.token = ""
+		log.WithField("credential", source.name).Info("oauth2.token_invalidated")
+	}
+}
@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenServer is a stand-in OAuth2 token endpoint that issues numbered tokens
+func tokenServer(expiresIn int64) (*httptest.Server, *int64) {
+	var issued int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("grant_type") {
+		case OAuth2GrantClientCredentials:
+			if clientId, clientSecret, _ := r.BasicAuth(); clientId != "broker" || clientSecret != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "invalid_client"}`))
+				return
+			}
+		case OAuth2GrantRefreshToken:
+			if r.Form.Get("refresh_token") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_grant"}`))
+				return
+			}
+		}
+		n := atomic.AddInt64(&issued, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  fmt.Sprintf("token%d", n),
+			"token_type":    "Bearer",
+			"expires_in":    expiresIn,
+			"refresh_token": fmt.Sprintf("refresh%d", n),
+			"scope":         r.Form.Get("scope"),
+		})
+	}))
+	return server, &issued
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	server, issued := tokenServer(3600)
+	defer server.Close()
+
+	source := newOAuth2TokenSource("test", &OAuth2Config{TokenURL: server.URL, ClientID: "broker", ClientSecret: "s3cret"}, http.DefaultTransport)
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		token, err := source.accessToken(context.Background(), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token1" {
+			t.Errorf("expected the cached token, got %v", token)
+		}
+	}
+
+	// tokens are refreshed shortly before they expire
+	token, _ := source.accessToken(context.Background(), now.Add(3590*time.Second))
+	if token != "token2" || *issued != 2 {
+		t.Errorf("expected a new token close to expiry, got %v (%v issued)", token, *issued)
+	}
+
+	badSource := newOAuth2TokenSource("test", &OAuth2Config{TokenURL: server.URL, ClientID: "broker", ClientSecret: "wrong"}, http.DefaultTransport)
+	if _, err := badSource.accessToken(context.Background(), now); err == nil {
+		t.Error("expected an error for rejected client credentials")
+	}
+}
+
+func TestOAuth2RefreshTokenRotation(t *testing.T) {
+	var refreshTokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		refreshTokens = append(refreshTokens, r.Form.Get("refresh_token"))
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 60, "refresh_token": "refresh%d"}`, len(refreshTokens), len(refreshTokens))
+	}))
+	defer server.Close()
+
+	source := newOAuth2TokenSource("test", &OAuth2Config{TokenURL: server.URL, GrantType: OAuth2GrantRefreshToken, RefreshToken: "initial"}, http.DefaultTransport)
+	now := time.Now()
+	source.accessToken(context.Background(), now)
+	// 60s tokens are refreshed after 30s
+	source.accessToken(context.Background(), now.Add(31*time.Second))
+
+	if len(refreshTokens) != 2 || refreshTokens[0] != "initial" || refreshTokens[1] != "refresh1" {
+		t.Errorf("expected the rotated refresh token to be used, got %v", refreshTokens)
+	}
+}
+
+func TestOAuth2ReauthOnUnauthorized(t *testing.T) {
+	tokens, issued := tokenServer(3600)
+	defer tokens.Close()
+
+	// the destination has revoked token1
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer destination.Close()
+
+	source := newOAuth2TokenSource("test", &OAuth2Config{TokenURL: tokens.URL, ClientID: "broker", ClientSecret: "s3cret"}, http.DefaultTransport)
+	headers, err := source.authHeaders(context.Background(), nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := newReauthRoundTripper(http.DefaultTransport, source, nil, headers, http.DefaultTransport, log.NewEntry(log.StandardLogger()))
+	req, _ := http.NewRequest("GET", destination.URL, nil)
+	req.Header.Set("Authorization", headers["Authorization"])
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || *issued != 2 {
+		t.Errorf("expected the request to be retried with a new token, got HTTP %v (%v issued)", resp.StatusCode, *issued)
+	}
+}
+
+func TestBuildAuthenticators(t *testing.T) {
+	oauth2 := &OAuth2Config{TokenURL: "https://auth.example.com/token", ClientID: "broker"}
+	config := &InboundProxyConfig{
+		Credentials: []CredentialConfig{{Name: "jira", OAuth2: oauth2}},
+		Allowlist: Allowlist{
+			{URL: "https://jira.example.com/rest/api/2/issue/:id", Auth: &AuthConfig{Credential: "jira"}},
+			{URL: "https://jira.example.com/rest/api/2/search", Auth: &AuthConfig{Credential: "jira"}},
+			{URL: "https://api.example.com/v1/:thing", Auth: &AuthConfig{OAuth2: oauth2}},
+		},
+	}
+	if err := config.buildAuthenticators(http.DefaultTransport, nil); err != nil {
+		t.Fatal(err)
+	}
+	if config.Allowlist[0].authenticator != config.Allowlist[1].authenticator {
+		t.Error("expected items using the same credential to share tokens")
+	}
+	if config.Allowlist[2].authenticator == nil || config.Allowlist[2].authenticator == config.Allowlist[0].authenticator {
+		t.Error("expected an inline oauth2 block to get its own token source")
+	}
+
+	config.Allowlist[0].Auth = &AuthConfig{Credential: "confluence"}
+	if err := config.buildAuthenticators(http.DefaultTransport, nil); err == nil {
+		t.Error("expected an error for an unknown credential")
+	}
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitKeys bounds the number of per-key limiters. Keys come from path params, so a caller could otherwise grow this map without limit.
+const maxRateLimitKeys = 10000
+
+const globalRateLimitName = "global"
+
+type rateLimiter struct {
+	name     string
+	config   *RateLimitConfig
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newRateLimiter(name string, config *RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		name:     name,
+		config:   config,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+func (rl *rateLimiter) burst() int {
+	if rl.config.Burst > 0 {
+		return rl.config.Burst
+	}
+	return int(math.Max(1, math.Ceil(rl.config.RequestsPerSecond)))
+}
+
+func (rl *rateLimiter) limiterFor(params map[string]string) *rate.Limiter {
+	key := ""
+	if rl.config.KeyParam != "" {
+		key = params[rl.config.KeyParam]
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limiter, exists := rl.limiters[key]
+	if !exists {
+		if len(rl.limiters) >= maxRateLimitKeys {
+			// start over rather than evicting individual keys; this only briefly relaxes the limits
+			rl.limiters = map[string]*rate.Limiter{}
+		}
+		limiter = rate.NewLimiter(rate.Limit(rl.config.RequestsPerSecond), rl.burst())
+		rl.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// reserve takes a token for the request, returning a reservation that may need to be waited on
+func (rl *rateLimiter) reserve(params map[string]string, now time.Time) *rate.Reservation {
+	return rl.limiterFor(params).ReserveN(now, 1)
+}
+
+type rateLimitResult struct {
+	allowed    bool
+	limit      string
+	retryAfter time.Duration
+}
+
+// checkRateLimits takes a token from every applicable limiter. If any of them are exhausted, no tokens are consumed.
+func checkRateLimits(now time.Time, params map[string]string, limiters ...*rateLimiter) rateLimitResult {
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	result := rateLimitResult{allowed: true}
+
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		reservation := limiter.reserve(params, now)
+		reservations = append(reservations, reservation)
+
+		var delay time.Duration
+		if reservation.OK() {
+			delay = reservation.DelayFrom(now)
+		} else {
+			delay = time.Second
+		}
+		if delay > 0 && delay > result.retryAfter {
+			result = rateLimitResult{allowed: false, limit: limiter.name, retryAfter: delay}
+		}
+	}
+
+	if !result.allowed {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+		rateLimitExceededCounter.WithLabelValues(result.limit).Inc()
+	}
+
+	return result
+}
+
+// retryAfterSeconds rounds a delay up to whole seconds for the Retry-After header
+func retryAfterSeconds(delay time.Duration) int {
+	return int(math.Max(1, math.Ceil(delay.Seconds())))
+}
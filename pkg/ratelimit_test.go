@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitKeyParam(t *testing.T) {
+	limiter := newRateLimiter("test", &RateLimitConfig{RequestsPerSecond: 1, Burst: 2, KeyParam: "project"})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if result := checkRateLimits(now, map[string]string{"project": "a"}, limiter); !result.allowed {
+			t.Fatalf("request %d for project a should be allowed", i)
+		}
+	}
+
+	result := checkRateLimits(now, map[string]string{"project": "a"}, limiter)
+	if result.allowed {
+		t.Fatal("third request for project a should be rate limited")
+	}
+	if result.limit != "test" || retryAfterSeconds(result.retryAfter) != 1 {
+		t.Errorf("unexpected rate limit result: %+v", result)
+	}
+
+	// other keys have their own bucket
+	if result := checkRateLimits(now, map[string]string{"project": "b"}, limiter); !result.allowed {
+		t.Error("request for project b should be allowed")
+	}
+
+	// tokens refill over time
+	if result := checkRateLimits(now.Add(time.Second), map[string]string{"project": "a"}, limiter); !result.allowed {
+		t.Error("request for project a should be allowed after a second")
+	}
+}
+
+func TestRateLimitRejectionDoesNotConsumeTokens(t *testing.T) {
+	global := newRateLimiter(globalRateLimitName, &RateLimitConfig{RequestsPerSecond: 1, Burst: 1})
+	item := newRateLimiter("item", &RateLimitConfig{RequestsPerSecond: 1, Burst: 1})
+	now := time.Now()
+
+	// exhaust the item limiter only
+	if result := checkRateLimits(now, nil, item); !result.allowed {
+		t.Fatal("first request should be allowed")
+	}
+
+	// rejected by the item limiter, so the global token should be given back
+	if result := checkRateLimits(now, nil, global, item); result.allowed || result.limit != "item" {
+		t.Fatalf("expected item rate limit, got %+v", result)
+	}
+
+	if result := checkRateLimits(now, nil, global); !result.allowed {
+		t.Error("global limiter should still have a token")
+	}
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const livenessPath = "/livez"
+const readinessPath = "/readyz"
+
+// ComponentStatus is the readiness of one part of the broker, with a message saying why
+type ComponentStatus struct {
+	Ready   bool   `json:"ready"`
+	Message string `json:"message"`
+}
+
+type ReadinessStatus struct {
+	Ready      bool                       `json:"ready"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// readinessChecker decides whether the broker can serve requests from Semgrep: heartbeats must be succeeding,
+// the tunnel must have recent handshakes, and the inbound listener must be serving
+type readinessChecker struct {
+	config    HealthConfig
+	heartbeat *HeartbeatConfig
+	wireguard *WireguardBase
+	listening atomic.Bool
+}
+
+func (checker *readinessChecker) checkHeartbeat(now time.Time) ComponentStatus {
+	lastSuccess := checker.heartbeat.lastSuccess()
+	if lastSuccess.IsZero() {
+		return ComponentStatus{Message: "no heartbeat has succeeded yet"}
+	}
+	age := now.Sub(lastSuccess).Round(time.Second)
+	if checker.config.MaxHeartbeatAgeSeconds > 0 && age > time.Duration(checker.config.MaxHeartbeatAgeSeconds)*time.Second {
+		return ComponentStatus{Message: fmt.Sprintf("last successful heartbeat was %v ago", age)}
+	}
+	return ComponentStatus{Ready: true, Message: fmt.Sprintf("last successful heartbeat was %v ago", age)}
+}
+
+func (checker *readinessChecker) checkWireguard(now time.Time) ComponentStatus {
+	monitor := checker.wireguard.monitor
+	if monitor == nil {
+		return ComponentStatus{Message: "wireguard is not running"}
+	}
+	peers, err := monitor.currentStats()
+	if err != nil {
+		return ComponentStatus{Message: fmt.Sprintf("failed to get wireguard stats: %v", err)}
+	}
+
+	var stale []string
+	var oldest time.Duration
+	for _, peer := range peers {
+		if peer.LastHandshake.IsZero() {
+			stale = append(stale, fmt.Sprintf("no handshake with %v yet", peer.PublicKey))
+			continue
+		}
+		age := now.Sub(peer.LastHandshake).Round(time.Second)
+		if checker.config.MaxHandshakeAgeSeconds > 0 && age > time.Duration(checker.config.MaxHandshakeAgeSeconds)*time.Second {
+			stale = append(stale, fmt.Sprintf("last handshake with %v was %v ago", peer.PublicKey, age))
+		}
+		oldest = max(oldest, age)
+	}
+	if len(stale) > 0 {
+		return ComponentStatus{Message: strings.Join(stale, "; ")}
+	}
+	return ComponentStatus{Ready: true, Message: fmt.Sprintf("oldest handshake was %v ago", oldest)}
+}
+
+func (checker *readinessChecker) checkListener() ComponentStatus {
+	if !checker.listening.Load() {
+		return ComponentStatus{Message: "inbound proxy is not serving"}
+	}
+	return ComponentStatus{Ready: true, Message: "inbound proxy is serving"}
+}
+
+func (checker *readinessChecker) check(now time.Time) ReadinessStatus {
+	status := ReadinessStatus{
+		Ready: true,
+		Components: map[string]ComponentStatus{
+			"heartbeat": checker.checkHeartbeat(now),
+			"wireguard": checker.checkWireguard(now),
+			"listener":  checker.checkListener(),
+		},
+	}
+	for _, component := range status.Components {
+		status.Ready = status.Ready && component.Ready
+	}
+	return status
+}
+
+// setup serves the liveness and readiness endpoints on the router
+func (checker *readinessChecker) setup(r *gin.Engine) {
+	r.GET(livenessPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "OK"})
+	})
+	r.GET(readinessPath, func(c *gin.Context) {
+		status := checker.check(time.Now())
+		statusCode := http.StatusOK
+		if !status.Ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+		c.JSON(statusCode, status)
+	})
+}
+
+// listen serves the liveness and readiness endpoints outside of the tunnel, if a listen address is configured
+func (checker *readinessChecker) listen() error {
+	if checker.config.ListenAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", checker.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to start health listener: %v", err)
+	}
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	checker.setup(r)
+	go func() {
+		if err := r.RunListener(listener); err != nil {
+			log.Panic(fmt.Errorf("failed to start health server: %v", err))
+		}
+	}()
+	log.WithFields(log.Fields{"listen": listener.Addr().String(), "liveness_path": livenessPath, "readiness_path": readinessPath}).Info("health.start")
+	return nil
+}
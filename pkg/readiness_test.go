@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testReadinessChecker(lastHeartbeat time.Time, lastHandshake time.Time) *readinessChecker {
+	heartbeat := &HeartbeatConfig{status: &heartbeatStatus{}}
+	if !lastHeartbeat.IsZero() {
+		heartbeat.status.lastSuccess.Store(lastHeartbeat.UnixNano())
+	}
+	uapi := "public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33\n"
+	if !lastHandshake.IsZero() {
+		uapi += fmt.Sprintf("last_handshake_time_sec=%d\n", lastHandshake.Unix())
+	}
+	wireguard := &WireguardBase{monitor: newWireguardMonitor(WireguardStatsConfig{}, func() (string, error) { return uapi, nil })}
+
+	checker := &readinessChecker{
+		config:    HealthConfig{MaxHeartbeatAgeSeconds: 180, MaxHandshakeAgeSeconds: 300},
+		heartbeat: heartbeat,
+		wireguard: wireguard,
+	}
+	checker.listening.Store(true)
+	return checker
+}
+
+func TestReadiness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name          string
+		lastHeartbeat time.Time
+		lastHandshake time.Time
+		notReady      string
+	}{
+		{"ready", now.Add(-time.Minute), now.Add(-2 * time.Minute), ""},
+		{"no heartbeat", time.Time{}, now.Add(-2 * time.Minute), "heartbeat"},
+		{"stale heartbeat", now.Add(-5 * time.Minute), now.Add(-2 * time.Minute), "heartbeat"},
+		{"no handshake", now.Add(-time.Minute), time.Time{}, "wireguard"},
+		{"stale handshake", now.Add(-time.Minute), now.Add(-10 * time.Minute), "wireguard"},
+	}
+	for _, test := range tests {
+		status := testReadinessChecker(test.lastHeartbeat, test.lastHandshake).check(now)
+		if status.Ready != (test.notReady == "") {
+			t.Errorf("%v: expected ready to be %v, got %+v", test.name, test.notReady == "", status)
+		}
+		for name, component := range status.Components {
+			if component.Ready == (name == test.notReady) {
+				t.Errorf("%v: unexpected %v status %+v", test.name, name, component)
+			}
+		}
+	}
+
+	checker := testReadinessChecker(now.Add(-time.Minute), now.Add(-time.Minute))
+	checker.listening.Store(false)
+	if status := checker.check(now); status.Ready || status.Components["listener"].Ready {
+		t.Errorf("expected not to be ready when the listener isn't serving, got %+v", status)
+	}
+}
+
+func TestMaxHeartbeatAgeDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := loadTestReloadConfig(t, path, testReloadConfig)
+	if config.Inbound.Health.MaxHeartbeatAgeSeconds != 180 {
+		t.Errorf("expected the max heartbeat age to default to three intervals, got %v", config.Inbound.Health.MaxHeartbeatAgeSeconds)
+	}
+
+	config = loadTestReloadConfig(t, path, strings.Replace(testReloadConfig, "/ping", "/ping\n    intervalSeconds: 300", 1))
+	if config.Inbound.Health.MaxHeartbeatAgeSeconds != 900 {
+		t.Errorf("expected the max heartbeat age to follow the heartbeat interval, got %v", config.Inbound.Health.MaxHeartbeatAgeSeconds)
+	}
+
+	// 0 still disables the check
+	config = loadTestReloadConfig(t, path, testReloadConfig+"  health:\n    maxHeartbeatAgeSeconds: 0\n")
+	if config.Inbound.Health.MaxHeartbeatAgeSeconds != 0 {
+		t.Errorf("expected the max heartbeat age to be disabled, got %v", config.Inbound.Health.MaxHeartbeatAgeSeconds)
+	}
+}
@@ -0,0 +1,337 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultRedactedHeaders are always masked in logs, since they usually carry credentials
+var defaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"Private-Token",
+	"Job-Token",
+	"X-Api-Key",
+	"X-Amz-Security-Token",
+}
+
+// defaultRedactedQueryParams are always masked in logged and audited URLs, since they usually carry credentials
+var defaultRedactedQueryParams = []string{
+	"access_token",
+	"private_token",
+	"job_token",
+	"token",
+	"api_key",
+	"apikey",
+	"key",
+	"client_secret",
+	"password",
+	"signature",
+	"sig",
+	"X-Amz-Credential",
+	"X-Amz-Signature",
+	"X-Amz-Security-Token",
+}
+
+// defaultRedactedPatterns match common token formats anywhere in logged bodies and headers
+var defaultRedactedPatterns = []string{
+	`gh[pousr]_[A-Za-z0-9]{36,255}`,
+	`github_pat_[A-Za-z0-9_]{22,255}`,
+	`glpat-[A-Za-z0-9_-]{20,}`,
+	`(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`,
+}
+
+const (
+	jsonPathField = iota
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathDescendant
+)
+
+type jsonPathSegment struct {
+	kind  int
+	name  string
+	index int
+}
+
+// jsonPath is the subset of JSONPath needed to select fields to mask: $.a.b, $['a'], $.a[0], $.a[*].b, $.* and $..b
+type jsonPath []jsonPathSegment
+
+var jsonPathTokenPattern = regexp.MustCompile(`^(?:\.\.([A-Za-z0-9_-]+)|\.([A-Za-z0-9_-]+)|\.\*|\[\*\]|\[(\d+)\]|\['([^']*)'\]|\["([^"]*)"\])`)
+
+func parseJSONPath(path string) (jsonPath, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("jsonpath %q must start with $", path)
+	}
+	var parsed jsonPath
+	rest := path[1:]
+	for rest != "" {
+		match := jsonPathTokenPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unsupported jsonpath %q at %q", path, rest)
+		}
+		switch {
+		case match[1] != "":
+			parsed = append(parsed, jsonPathSegment{kind: jsonPathDescendant, name: match[1]})
+		case match[2] != "":
+			parsed = append(parsed, jsonPathSegment{kind: jsonPathField, name: match[2]})
+		case match[3] != "":
+			index, _ := strconv.Atoi(match[3])
+			parsed = append(parsed, jsonPathSegment{kind: jsonPathIndex, index: index})
+		case match[4] != "" || match[5] != "":
+			parsed = append(parsed, jsonPathSegment{kind: jsonPathField, name: match[4] + match[5]})
+		default:
+			parsed = append(parsed, jsonPathSegment{kind: jsonPathWildcard})
+		}
+		rest = rest[len(match[0]):]
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("jsonpath %q would mask the whole body", path)
+	}
+	return parsed, nil
+}
+
+// lastName returns the name of the field the path ends with, if any
+func (path jsonPath) lastName() string {
+	last := path[len(path)-1]
+	if last.kind == jsonPathField || last.kind == jsonPathDescendant {
+		return last.name
+	}
+	return ""
+}
+
+// definite reports whether the path selects at most one value, i.e. it has no wildcards or recursive descent
+func (path jsonPath) definite() bool {
+	for _, segment := range path {
+		if segment.kind != jsonPathField && segment.kind != jsonPathIndex {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value a definite path selects in a decoded JSON value, if there is one
+func (path jsonPath) lookup(value interface{}) (interface{}, bool) {
+	for _, segment := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, exists := v[segment.name]
+			if segment.kind != jsonPathField || !exists {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			if segment.kind != jsonPathIndex || segment.index >= len(v) {
+				return nil, false
+			}
+			value = v[segment.index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// mask replaces the values the path selects in a decoded JSON value
+func (path jsonPath) mask(value interface{}) interface{} {
+	if len(path) == 0 {
+		return RedactedString
+	}
+	segment, rest := path[0], path[1:]
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			switch {
+			case segment.kind == jsonPathWildcard, segment.kind == jsonPathField && key == segment.name:
+				v[key] = rest.mask(child)
+			case segment.kind == jsonPathDescendant && key == segment.name:
+				v[key] = rest.mask(child)
+			case segment.kind == jsonPathDescendant:
+				v[key] = path.mask(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			switch {
+			case segment.kind == jsonPathWildcard, segment.kind == jsonPathIndex && i == segment.index:
+				v[i] = rest.mask(child)
+			case segment.kind == jsonPathDescendant:
+				v[i] = path.mask(child)
+			}
+		}
+	}
+	return value
+}
+
+func (config RedactionConfig) Validate() error {
+	_, err := config.compile()
+	return err
+}
+
+type compiledRedaction struct {
+	headers     map[string]bool
+	queryParams map[string]bool
+	jsonPaths   []jsonPath
+	// keyPattern masks the fields named by jsonPaths in bodies that can't be parsed, e.g. because they were truncated
+	keyPattern *regexp.Regexp
+	patterns   []*regexp.Regexp
+}
+
+func (config RedactionConfig) compile() (*compiledRedaction, error) {
+	compiled := &compiledRedaction{headers: map[string]bool{}, queryParams: map[string]bool{}}
+	for _, header := range append(append([]string{}, defaultRedactedHeaders...), config.Headers...) {
+		compiled.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, param := range append(append([]string{}, defaultRedactedQueryParams...), config.QueryParams...) {
+		compiled.queryParams[strings.ToLower(param)] = true
+	}
+
+	var keys []string
+	for _, rawPath := range config.JSONPaths {
+		path, err := parseJSONPath(rawPath)
+		if err != nil {
+			return nil, err
+		}
+		compiled.jsonPaths = append(compiled.jsonPaths, path)
+		if name := path.lastName(); name != "" {
+			keys = append(keys, regexp.QuoteMeta(name))
+		}
+	}
+	if len(keys) > 0 {
+		compiled.keyPattern = regexp.MustCompile(`("(?:` + strings.Join(keys, "|") + `)"\s*:\s*)(?:"(?:[^"\\]|\\.)*(?:"|$)|[^,}\]\s]+)`)
+	}
+
+	for _, pattern := range append(append([]string{}, defaultRedactedPatterns...), config.Patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", pattern, err)
+		}
+		compiled.patterns = append(compiled.patterns, re)
+	}
+	return compiled, nil
+}
+
+// logRedactor masks credentials and sensitive fields in logged headers and bodies, and truncates logged bodies
+type logRedactor struct {
+	*compiledRedaction
+	maxBodyBytes int
+}
+
+func (config LoggingConfig) buildRedactor() (*logRedactor, error) {
+	compiled, err := config.Redaction.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &logRedactor{compiledRedaction: compiled, maxBodyBytes: config.MaxBodyBytes}, nil
+}
+
+func (redactor *logRedactor) redactString(s string) string {
+	for _, pattern := range redactor.patterns {
+		s = pattern.ReplaceAllString(s, RedactedString)
+	}
+	return s
+}
+
+// redactHeaders returns a copy of the headers that's safe to log
+func (redactor *logRedactor) redactHeaders(headers http.Header) http.Header {
+	redacted := make(http.Header, len(headers))
+	for name, values := range headers {
+		redactedValues := make([]string, len(values))
+		for i, value := range values {
+			if redactor.headers[http.CanonicalHeaderKey(name)] {
+				redactedValues[i] = RedactedString
+			} else {
+				redactedValues[i] = redactor.redactString(value)
+			}
+		}
+		redacted[name] = redactedValues
+	}
+	return redacted
+}
+
+// redactQuery returns a query string that's safe to log, with credential query params masked
+func (redactor *logRedactor) redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// a query that can't be parsed could hide a credential anywhere
+		return RedactedString
+	}
+	for name, values := range query {
+		for i := range values {
+			if redactor.queryParams[strings.ToLower(name)] {
+				values[i] = RedactedString
+			} else {
+				values[i] = redactor.redactString(values[i])
+			}
+		}
+	}
+	return query.Encode()
+}
+
+// redactURL returns a URL that's safe to log or audit, with its password and credential query params masked
+func (redactor *logRedactor) redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = redactor.redactQuery(u.RawQuery)
+	return redacted.Redacted()
+}
+
+// redactBody returns a body that's safe to log. captured may be just the start of a body that was totalBytes long.
+func (redactor *logRedactor) redactBody(captured []byte, totalBytes int64) string {
+	complete := int64(len(captured)) >= totalBytes
+	if !complete {
+		captured = trimPartialToken(captured)
+	}
+	body := captured
+
+	if len(redactor.jsonPaths) > 0 {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(captured))
+		decoder.UseNumber()
+		if complete && decoder.Decode(&value) == nil {
+			for _, path := range redactor.jsonPaths {
+				value = path.mask(value)
+			}
+			masked := &bytes.Buffer{}
+			encoder := json.NewEncoder(masked)
+			encoder.SetEscapeHTML(false)
+			if encoder.Encode(value) == nil {
+				body = bytes.TrimRight(masked.Bytes(), "\n")
+			}
+		} else if redactor.keyPattern != nil {
+			body = redactor.keyPattern.ReplaceAll(captured, []byte(`${1}"`+RedactedString+`"`))
+		}
+	}
+
+	redacted := redactor.redactString(string(body))
+	if redactor.maxBodyBytes > 0 && len(redacted) > redactor.maxBodyBytes {
+		cut := redactor.maxBodyBytes
+		for cut > 0 && !utf8.RuneStart(redacted[cut]) {
+			cut--
+		}
+		redacted = redacted[:cut]
+		complete = false
+	}
+	if !complete {
+		redacted += fmt.Sprintf("...[truncated, %d bytes total]", totalBytes)
+	}
+	return redacted
+}
+
+// trimPartialToken drops whatever follows the last separator in a captured body that was cut short, since a token
+// that was cut in half could no longer be matched by the redaction patterns, and the cut could split a UTF-8 rune
+func trimPartialToken(captured []byte) []byte {
+	return captured[:bytes.LastIndexAny(captured, " \t\r\n\"',;:&?{}[]()<>")+1]
+}
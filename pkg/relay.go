@@ -14,7 +14,6 @@ import (
 	"github.com/PaesslerAG/jsonpath"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
-	ginprometheus "github.com/zsais/go-gin-prometheus"
 	"gopkg.in/dealancer/validate.v2"
 )
 
@@ -116,6 +115,11 @@ func (config *OutboundProxyConfig) Start() error {
 		return nil
 	}
 
+	redactor, err := config.Logging.buildRedactor()
+	if err != nil {
+		return fmt.Errorf("invalid relay logging config: %v", err)
+	}
+
 	for k, v := range config.Relay {
 		log.WithField("path", fmt.Sprintf("/relay/%v", k)).WithField("destinationUrl", v.DestinationURL).WithField("jsonPath", v.JSONPath).WithField("equals", v.Equals).WithField("hasPrefix", v.HasPrefix).WithField("contains", v.Contains).Info("relay.configured")
 	}
@@ -130,8 +134,7 @@ func (config *OutboundProxyConfig) Start() error {
 	log.WithField("path", healthcheckPath).Info("healthcheck.configured")
 
 	// setup metrics
-	p := ginprometheus.NewPrometheus("gin")
-	p.Use(r)
+	config.Metrics.setup(r)
 
 	// setup http proxy
 	r.Any("/relay/:name", func(c *gin.Context) {
@@ -163,11 +166,11 @@ func (config *OutboundProxyConfig) Start() error {
 		}
 
 		if config.Logging.LogRequestBody || filteredRelayConfig.LogRequestBody {
-			logger = logger.WithField("request_body", buf.String())
+			logger = logger.WithField("request_body", redactor.redactBody(buf.Bytes(), int64(buf.Len())))
 		}
 
 		if config.Logging.LogRequestHeaders {
-			logger = logger.WithField("request_headers", c.Request.Header)
+			logger = logger.WithField("request_headers", redactor.redactHeaders(c.Request.Header))
 		}
 
 		if !match {
@@ -197,17 +200,17 @@ func (config *OutboundProxyConfig) Start() error {
 			},
 			ModifyResponse: func(resp *http.Response) error {
 				respLogger := logger
-				if config.Logging.LogResponseBody || filteredRelayConfig.LogResponseBody {
-					respBuf := &bytes.Buffer{}
-					respBuf.ReadFrom(resp.Body)
-					defer resp.Body.Close()
-					resp.Body = io.NopCloser(respBuf)
-					respLogger = logger.WithField("response_body", respBuf.String())
-				}
 				if config.Logging.LogResponseHeaders || filteredRelayConfig.LogResponseHeaders {
-					respLogger = respLogger.WithField("response_headers", resp.Header)
+					respLogger = respLogger.WithField("response_headers", redactor.redactHeaders(resp.Header))
+				}
+				if config.Logging.LogResponseBody || filteredRelayConfig.LogResponseBody {
+					// the response is logged once its body has been streamed to the client
+					resp.Body = newBodyCapture(resp.Body, config.Logging.MaxBodyBytes, func(captured []byte, totalBytes int64) {
+						respLogger.WithField("response_body", redactor.redactBody(captured, totalBytes)).Info("relay.proxy_response")
+					})
+				} else {
+					respLogger.Info("relay.proxy_response")
 				}
-				respLogger.Info("relay.proxy_response")
 				return nil
 			},
 		}
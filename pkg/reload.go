@@ -0,0 +1,223 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/dealancer/validate.v2"
+)
+
+// reloadableInboundSections are the fields of InboundProxyConfig that can change without restarting the broker.
+// The presets and credentials are included because they only add to the allowlist.
+var reloadableInboundSections = []string{"Allowlist", "Denylist", "Logging", "HttpClient", "GitHub", "GitLab", "BitBucket", "Credentials"}
+
+// inboundProxyState is everything the proxy builds from the reloadable sections of the config. Each request uses
+// the state that was current when it started, so a reload never affects requests in flight.
+type inboundProxyState struct {
+	config           *InboundProxyConfig
+	allowlist        *CompiledAllowlist
+	denylist         *CompiledAllowlist
+	itemRateLimiters map[*AllowlistItem]*rateLimiter
+	transports       *HttpTransports
+	cache            *ResponseCache
+	redactor         *logRedactor
+	skipPaths        map[string]bool
+}
+
+// buildState builds the state for the config. previous is the state the proxy is running with, if any, whose
+// token sources and rate limiters are carried over where their config hasn't changed.
+func (config *InboundProxyConfig) buildState(previous *inboundProxyState) (*inboundProxyState, error) {
+	state := &inboundProxyState{config: config, itemRateLimiters: map[*AllowlistItem]*rateLimiter{}, skipPaths: map[string]bool{}}
+	var previousConfig *InboundProxyConfig
+	if previous != nil {
+		previousConfig = previous.config
+	}
+	var err error
+
+	// parse allowlist once up front, rather than on every request
+	state.allowlist, err = config.Allowlist.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %v", err)
+	}
+
+	for i := range config.Denylist {
+		if config.Denylist[i].Methods == 0 {
+			return nil, fmt.Errorf("invalid denylist: denylist item %d (%v) has no methods", i, config.Denylist[i].URL)
+		}
+	}
+	state.denylist, err = config.Denylist.CompileDenylist()
+	if err != nil {
+		return nil, fmt.Errorf("invalid denylist: %v", err)
+	}
+
+	reusedRateLimiters := map[*rateLimiter]bool{}
+	for i := range config.Allowlist {
+		item := &config.Allowlist[i]
+		if item.RateLimit == nil {
+			continue
+		}
+		limiter := previous.reusableRateLimiter(item, reusedRateLimiters)
+		if limiter == nil {
+			limiter = newRateLimiter(item.URL, item.RateLimit)
+		}
+		state.itemRateLimiters[item] = limiter
+	}
+
+	// setup log redaction
+	state.redactor, err = config.Logging.buildRedactor()
+	if err != nil {
+		return nil, fmt.Errorf("invalid logging config: %v", err)
+	}
+	for _, path := range config.Logging.SkipPaths {
+		state.skipPaths[path] = true
+	}
+
+	// build http transports (needed for custom CA certs, client certs, etc...)
+	state.transports, err = config.HttpClient.BuildTransports()
+	if err != nil {
+		return nil, err
+	}
+	for i := range config.Allowlist {
+		if profile := config.Allowlist[i].TLSProfile; profile != "" && !state.transports.HasProfile(profile) {
+			return nil, fmt.Errorf("invalid allowlist: allowlist item %d (%v) references unknown tls profile %v", i, config.Allowlist[i].URL, profile)
+		}
+	}
+
+	// setup credentials that the broker fetches itself, e.g. oauth2 tokens
+	if err := config.buildAuthenticators(state.transports, previousConfig); err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %v", err)
+	}
+	config.reuseGitHubAppTokenSource(previousConfig)
+
+	// setup response cache once an allowlist item uses it. the cache section can't be reloaded, so the cache is kept
+	if previous != nil {
+		state.cache = previous.cache
+	}
+	if state.cache == nil && slices.ContainsFunc(config.Allowlist, func(item AllowlistItem) bool { return item.Cache }) {
+		state.cache, err = config.Cache.build()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// reusableRateLimiter returns the rate limiter of an allowlist item with the same url and rate limit config, so that
+// reloading the config doesn't reset the item's limit. Each limiter is only reused once.
+func (state *inboundProxyState) reusableRateLimiter(item *AllowlistItem, reused map[*rateLimiter]bool) *rateLimiter {
+	if state == nil {
+		return nil
+	}
+	for previousItem, limiter := range state.itemRateLimiters {
+		if !reused[limiter] && previousItem.URL == item.URL && configEqual(reflect.ValueOf(previousItem.RateLimit), reflect.ValueOf(item.RateLimit)) {
+			reused[limiter] = true
+			return limiter
+		}
+	}
+	return nil
+}
+
+// configEqual compares two config values, ignoring unexported fields, since those hold runtime state rather than config
+func configEqual(a reflect.Value, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if a.Type().Field(i).IsExported() && !configEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return configEqual(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !configEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			value := b.MapIndex(key)
+			if !value.IsValid() || !configEqual(a.MapIndex(key), value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+}
+
+// restartRequiredSections returns the config sections that differ between the two configs but can't be reloaded
+func restartRequiredSections(current *InboundProxyConfig, next *InboundProxyConfig) []string {
+	var changed []string
+	currentValue, nextValue := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < currentValue.NumField(); i++ {
+		field := currentValue.Type().Field(i)
+		if !field.IsExported() || slices.Contains(reloadableInboundSections, field.Name) {
+			continue
+		}
+		if !configEqual(currentValue.Field(i), nextValue.Field(i)) {
+			changed = append(changed, field.Tag.Get("mapstructure"))
+		}
+	}
+	return changed
+}
+
+// Reload applies the reloadable sections of a new config to the running broker. The new config is fully validated
+// first, and if it can't be applied, the running config is left as it was.
+func (config *Config) Reload(next *Config) error {
+	current := config.Inbound.state
+	if current == nil {
+		return fmt.Errorf("inbound proxy is not running")
+	}
+
+	if err := validate.Validate(&next.Inbound); err != nil {
+		return fmt.Errorf("invalid inbound config: %v", err)
+	}
+	if changed := restartRequiredSections(&config.Inbound, &next.Inbound); len(changed) > 0 {
+		return fmt.Errorf("changes to %v require a restart", strings.Join(changed, ", "))
+	}
+
+	state, err := next.Inbound.buildState(current.Load())
+	if err != nil {
+		return err
+	}
+	// requests in flight keep using the previous transports. their connections are closed by the idle timeout once they finish.
+	previous := current.Swap(state)
+	previous.transports.CloseIdleConnections()
+
+	log.WithFields(log.Fields{
+		"allowlist_items": len(next.Inbound.Allowlist),
+		"denylist_items":  len(next.Inbound.Denylist),
+	}).Info("config.reloaded")
+	return nil
+}
+
+// effectiveConfig returns the config the broker is currently running with, including any reloaded sections
+func (config *Config) effectiveConfig() *Config {
+	effective := *config
+	if config.Inbound.state == nil {
+		return &effective
+	}
+	reloaded := reflect.ValueOf(config.Inbound.state.Load().config).Elem()
+	inbound := reflect.ValueOf(&effective.Inbound).Elem()
+	for _, name := range reloadableInboundSections {
+		inbound.FieldByName(name).Set(reloaded.FieldByName(name))
+	}
+	return &effective
+}
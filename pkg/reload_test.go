@@ -0,0 +1,265 @@
+package pkg
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testReloadConfig = `
+inbound:
+  wireguard:
+    localAddress: fdf0:59dc:33cf:9be8:0:0:0:1
+    privateKey: KJR4EeL83nexOFihmdYciri7Mo7ciAq/b5/S0lREcns=
+    peers:
+      - publicKey: 4EqJwDZ8X/qXB5u3Wpo2cxnKlysec93uhRvGWPix0lg=
+        allowedIps: fdf0:59dc:33cf:9be8:0:0:0:0/64
+  heartbeat:
+    url: http://[fdf0:59dc:33cf:9be8:0:0:0:0]/ping
+  allowlist:
+    - url: https://git.example.com/api/v4/projects
+      methods: [GET]
+`
+
+func loadTestReloadConfig(t *testing.T, path string, contents string) *Config {
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig([]string{path}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func assertAllowlisted(t *testing.T, config *Config, rawUrl string, expected bool) {
+	destination, _ := url.Parse(rawUrl)
+	if _, allowed := config.Inbound.state.Load().allowlist.FindMatch(http.MethodGet, destination); allowed != expected {
+		t.Errorf("expected %v to be allowed: %v", rawUrl, expected)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := loadTestReloadConfig(t, path, testReloadConfig)
+	state, err := config.Inbound.buildState(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Inbound.state = &atomic.Pointer[inboundProxyState]{}
+	config.Inbound.state.Store(state)
+
+	assertAllowlisted(t, config, "https://git.example.com/api/v4/projects", true)
+	assertAllowlisted(t, config, "https://git.example.com/api/v4/groups", false)
+
+	// allowlist changes are applied
+	next := loadTestReloadConfig(t, path, testReloadConfig+`
+    - url: https://git.example.com/api/v4/groups
+      methods: [GET]
+`)
+	if err := config.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	assertAllowlisted(t, config, "https://git.example.com/api/v4/groups", true)
+	if effective := config.effectiveConfig(); len(effective.Inbound.Allowlist) != 2 || len(config.Inbound.Allowlist) != 1 {
+		t.Errorf("expected the effective config to include the reloaded allowlist")
+	}
+
+	// invalid configs are rejected, and the current config is kept
+	invalid := loadTestReloadConfig(t, path, testReloadConfig+`
+    - url: https://git.example.com/api/v4/users
+      methods: [GET]
+      tlsProfile: missing
+`)
+	if err := config.Reload(invalid); err == nil || !strings.Contains(err.Error(), "unknown tls profile") {
+		t.Errorf("expected reload to be rejected, got %v", err)
+	}
+	assertAllowlisted(t, config, "https://git.example.com/api/v4/groups", true)
+
+	// changes to the tunnel require a restart
+	restart := loadTestReloadConfig(t, path, strings.Replace(testReloadConfig, "/ping", "/heartbeat", 1))
+	if err := config.Reload(restart); err == nil || !strings.Contains(err.Error(), "heartbeat require a restart") {
+		t.Errorf("expected reload to be rejected, got %v", err)
+	}
+}
+
+func TestRestartRequiredSections(t *testing.T) {
+	current := &InboundProxyConfig{Wireguard: WireguardBase{Peers: []WireguardPeer{{Endpoint: "gateway.example.com:51820"}}}}
+	next := &InboundProxyConfig{Wireguard: WireguardBase{Peers: []WireguardPeer{{Endpoint: "gateway.example.com:51820"}}}}
+
+	// runtime state isn't config
+	current.Wireguard.Peers[0].resolvedEndpoint = "192.0.2.1:51820"
+	current.Wireguard.monitor = &wireguardMonitor{}
+	next.Allowlist = Allowlist{{URL: "https://git.example.com/*"}}
+	if changed := restartRequiredSections(current, next); len(changed) != 0 {
+		t.Errorf("expected no sections to require a restart, got %v", changed)
+	}
+
+	next.Wireguard.Peers[0].Endpoint = "gateway2.example.com:51820"
+	next.Concurrency.Global.MaxInFlight = 10
+	if changed := restartRequiredSections(current, next); strings.Join(changed, ",") != "wireguard,concurrency" {
+		t.Errorf("expected wireguard and concurrency to require a restart, got %v", changed)
+	}
+}
+
+func TestConfigReloadKeepsTokenSources(t *testing.T) {
+	const tokenSourceConfig = `
+  credentials:
+    - name: jira
+      oauth2:
+        tokenUrl: https://auth.example.com/token
+        clientId: broker
+  github:
+    baseUrl: https://github.example.com/api/v3
+    app:
+      appId: 1234
+      privateKey: not-a-real-key
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := loadTestReloadConfig(t, path, testReloadConfig+`
+    - url: https://jira.example.com/rest/api/2/issue
+      methods: [GET]
+      auth:
+        credential: jira
+`+tokenSourceConfig)
+	state, err := config.Inbound.buildState(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Inbound.state = &atomic.Pointer[inboundProxyState]{}
+	config.Inbound.state.Store(state)
+
+	tokenSources := func() (*oauth2TokenSource, *gitHubAppTokenSource) {
+		var oauth2 *oauth2TokenSource
+		var gitHubApp *gitHubAppTokenSource
+		for _, item := range config.Inbound.state.Load().config.Allowlist {
+			switch authenticator := item.authenticator.(type) {
+			case *oauth2TokenSource:
+				oauth2 = authenticator
+			case *gitHubAppAuth:
+				gitHubApp = authenticator.source
+			}
+		}
+		return oauth2, gitHubApp
+	}
+	oauth2, gitHubApp := tokenSources()
+
+	// unchanged credentials keep their cached tokens, and use the new transports
+	next := loadTestReloadConfig(t, path, testReloadConfig+`
+    - url: https://jira.example.com/rest/api/2/issue
+      methods: [GET, POST]
+      auth:
+        credential: jira
+`+tokenSourceConfig)
+	if err := config.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if reloadedOAuth2, reloadedGitHubApp := tokenSources(); reloadedOAuth2 != oauth2 || reloadedGitHubApp != gitHubApp {
+		t.Errorf("expected unchanged token sources to be kept")
+	}
+	if oauth2.currentTransport() != config.Inbound.state.Load().transports {
+		t.Errorf("expected the kept token source to use the new transports")
+	}
+
+	// changed credentials get new token sources
+	next = loadTestReloadConfig(t, path, strings.ReplaceAll(testReloadConfig+`
+    - url: https://jira.example.com/rest/api/2/issue
+      methods: [GET]
+      auth:
+        credential: jira
+`+tokenSourceConfig, "broker", "broker2"))
+	next.Inbound.GitHub.App.AppID = 5678
+	if err := config.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if reloadedOAuth2, reloadedGitHubApp := tokenSources(); reloadedOAuth2 == oauth2 || reloadedGitHubApp == gitHubApp {
+		t.Errorf("expected changed credentials to get new token sources")
+	}
+}
+
+func TestConfigReloadEnablesCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := loadTestReloadConfig(t, path, testReloadConfig)
+	state, err := config.Inbound.buildState(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Inbound.state = &atomic.Pointer[inboundProxyState]{}
+	config.Inbound.state.Store(state)
+	if state.cache != nil {
+		t.Fatal("expected no cache without cached allowlist items")
+	}
+
+	// the cache is built when a reload enables it, and kept by later reloads
+	const cachedItem = `
+    - url: https://git.example.com/api/v4/groups
+      methods: [GET]
+      cache: true
+`
+	if err := config.Reload(loadTestReloadConfig(t, path, testReloadConfig+cachedItem)); err != nil {
+		t.Fatal(err)
+	}
+	cache := config.Inbound.state.Load().cache
+	if cache == nil {
+		t.Fatal("expected the reload to build the cache")
+	}
+	if err := config.Reload(loadTestReloadConfig(t, path, testReloadConfig+cachedItem)); err != nil {
+		t.Fatal(err)
+	}
+	if config.Inbound.state.Load().cache != cache {
+		t.Error("expected the cache to be kept")
+	}
+}
+
+func TestConfigReloadKeepsRateLimiters(t *testing.T) {
+	const rateLimitedItem = `
+    - url: https://git.example.com/api/v4/projects/:project
+      methods: [GET]
+      rateLimit:
+        requestsPerSecond: 1
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := loadTestReloadConfig(t, path, testReloadConfig+rateLimitedItem)
+	state, err := config.Inbound.buildState(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Inbound.state = &atomic.Pointer[inboundProxyState]{}
+	config.Inbound.state.Store(state)
+
+	rateLimiter := func() *rateLimiter {
+		state := config.Inbound.state.Load()
+		for item, limiter := range state.itemRateLimiters {
+			if item.URL == "https://git.example.com/api/v4/projects/:project" {
+				return limiter
+			}
+		}
+		return nil
+	}
+	limiter := rateLimiter()
+
+	// an item whose rate limit hasn't changed keeps its limiter, even if other items changed
+	next := loadTestReloadConfig(t, path, testReloadConfig+`
+    - url: https://git.example.com/api/v4/groups
+      methods: [GET]
+`+rateLimitedItem)
+	if err := config.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if rateLimiter() != limiter {
+		t.Errorf("expected the unchanged rate limiter to be kept")
+	}
+
+	// a changed rate limit gets a new limiter
+	next = loadTestReloadConfig(t, path, testReloadConfig+strings.Replace(rateLimitedItem, "requestsPerSecond: 1", "requestsPerSecond: 2", 1))
+	if err := config.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if rateLimiter() == limiter {
+		t.Errorf("expected the changed rate limit to get a new limiter")
+	}
+}
@@ -0,0 +1,220 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RetryErrorConnect = "connect"
+	RetryErrorReset   = "reset"
+	RetryErrorTimeout = "timeout"
+)
+
+var retryErrors = []string{RetryErrorConnect, RetryErrorReset, RetryErrorTimeout}
+
+var defaultRetryMethods = ParseHttpMethods([]string{"GET", "HEAD", "OPTIONS"})
+var defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+const defaultInitialBackoff = 200 * time.Millisecond
+const defaultMaxBackoff = 10 * time.Second
+
+// maxRetryDrainBytes limits how much of a retried response is read so that its connection can be reused
+const maxRetryDrainBytes = 64 << 10
+
+func (config *RetryConfig) Validate() error {
+	if config == nil {
+		return nil
+	}
+	for _, name := range config.Errors {
+		if !stringInSlice(name, retryErrors) {
+			return fmt.Errorf("unknown retry error %v (expected one of %v)", name, retryErrors)
+		}
+	}
+	return nil
+}
+
+func (config *RetryConfig) enabled() bool {
+	return config != nil && config.MaxAttempts > 1
+}
+
+func (config *RetryConfig) methods() HttpMethods {
+	if config.Methods == 0 {
+		return defaultRetryMethods
+	}
+	return config.Methods
+}
+
+func (config *RetryConfig) statusCodes() []int {
+	if len(config.StatusCodes) == 0 {
+		return defaultRetryStatusCodes
+	}
+	return config.StatusCodes
+}
+
+func (config *RetryConfig) errors() []string {
+	if len(config.Errors) == 0 {
+		return retryErrors
+	}
+	return config.Errors
+}
+
+func (config *RetryConfig) maxBackoff() time.Duration {
+	if config.MaxBackoffSeconds > 0 {
+		return time.Duration(config.MaxBackoffSeconds * float64(time.Second))
+	}
+	return defaultMaxBackoff
+}
+
+// backoff returns a random delay between 0 and an exponentially growing cap ("full jitter")
+func (config *RetryConfig) backoff(attempt int) time.Duration {
+	initial := defaultInitialBackoff
+	if config.InitialBackoffSeconds > 0 {
+		initial = time.Duration(config.InitialBackoffSeconds * float64(time.Second))
+	}
+	ceiling := math.Min(float64(config.maxBackoff()), float64(initial)*math.Pow(2, float64(attempt-1)))
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// canReplay checks whether the request body can be sent again
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// replaceBody swaps the request body for a buffered copy that can be replayed on retries
+func replaceBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// classifyRetryError maps a round trip error to one of the retryable error names, or "" if it isn't retryable
+func classifyRetryError(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect") {
+		return RetryErrorConnect
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryErrorReset
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryErrorTimeout
+	}
+	return ""
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// retryReason returns why the attempt should be retried, or "" if it shouldn't be
+func (config *RetryConfig) retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if reason := classifyRetryError(err); reason != "" && stringInSlice(reason, config.errors()) {
+			return reason
+		}
+		return ""
+	}
+	for _, statusCode := range config.statusCodes() {
+		if resp.StatusCode == statusCode {
+			return strconv.Itoa(resp.StatusCode)
+		}
+	}
+	return ""
+}
+
+type retryRoundTripper struct {
+	transport http.RoundTripper
+	config    *RetryConfig
+	logger    *log.Entry
+}
+
+// newRetryRoundTripper wraps the transport with the retry policy, if it's enabled
+func newRetryRoundTripper(transport http.RoundTripper, config *RetryConfig, logger *log.Entry) http.RoundTripper {
+	if !config.enabled() {
+		return transport
+	}
+	return &retryRoundTripper{transport: transport, config: config, logger: logger}
+}
+
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !rt.config.methods().Test(LookupHttpMethod(req.Method)) || !canReplay(req) {
+		return rt.transport.RoundTrip(req)
+	}
+
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.transport.RoundTrip(attemptReq)
+		if attempt >= rt.config.MaxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		reason := rt.config.retryReason(resp, err)
+		if reason == "" {
+			return resp, err
+		}
+
+		delay := rt.config.backoff(attempt)
+		if resp != nil && !rt.config.IgnoreRetryAfter {
+			if retryDelay, ok := retryAfter(resp, time.Now()); ok {
+				if retryDelay > rt.config.maxBackoff() {
+					// the destination wants us to wait longer than we're willing to, so give up now
+					return resp, err
+				}
+				delay = retryDelay
+			}
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryDrainBytes))
+			resp.Body.Close()
+		}
+
+		retryLogger := rt.logger.WithField("attempt", attempt+1).WithField("reason", reason).WithField("delay", delay)
+		if err != nil {
+			retryLogger = retryLogger.WithError(err)
+		}
+		retryLogger.Warn("proxy.retry")
+		retryCounter.WithLabelValues(reason).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		attemptReq = req.Clone(req.Context())
+		if req.GetBody != nil {
+			attemptReq.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
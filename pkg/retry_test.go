@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// flakyServer fails the first failures requests with the status code, then succeeds
+func flakyServer(failures int64, statusCode int, header http.Header) (*httptest.Server, *int64) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if atomic.AddInt64(&requests, 1) <= failures {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(statusCode)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, &requests
+}
+
+func doRetryRequest(t *testing.T, config *RetryConfig, req *http.Request) int {
+	resp, err := newRetryRoundTripper(http.DefaultTransport, config, log.NewEntry(log.StandardLogger())).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRetryStatusCodes(t *testing.T) {
+	server, requests := flakyServer(2, http.StatusBadGateway, nil)
+	defer server.Close()
+
+	config := &RetryConfig{MaxAttempts: 3, InitialBackoffSeconds: 0.001}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if statusCode := doRetryRequest(t, config, req); statusCode != http.StatusOK {
+		t.Errorf("expected HTTP 200 after retries, got %v", statusCode)
+	}
+	if *requests != 3 {
+		t.Errorf("expected 3 attempts, got %v", *requests)
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	server, requests := flakyServer(5, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	config := &RetryConfig{MaxAttempts: 2, InitialBackoffSeconds: 0.001}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if statusCode := doRetryRequest(t, config, req); statusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the last failure to be returned, got %v", statusCode)
+	}
+	if *requests != 2 {
+		t.Errorf("expected 2 attempts, got %v", *requests)
+	}
+}
+
+func TestRetryMethodsAndBodies(t *testing.T) {
+	server, requests := flakyServer(100, http.StatusBadGateway, nil)
+	defer server.Close()
+
+	config := &RetryConfig{MaxAttempts: 3, InitialBackoffSeconds: 0.001}
+
+	// POST isn't retried by default
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader("{}"))
+	doRetryRequest(t, config, req)
+	if *requests != 1 {
+		t.Errorf("expected POST not to be retried, got %v attempts", *requests)
+	}
+
+	// a body that can't be replayed isn't retried
+	atomic.StoreInt64(requests, 0)
+	config.Methods = ParseHttpMethods([]string{"POST"})
+	req, _ = http.NewRequest("POST", server.URL, io.NopCloser(strings.NewReader("{}")))
+	doRetryRequest(t, config, req)
+	if *requests != 1 {
+		t.Errorf("expected a one-shot body not to be retried, got %v attempts", *requests)
+	}
+
+	// a buffered body is replayed
+	atomic.StoreInt64(requests, 0)
+	req, _ = http.NewRequest("POST", server.URL, nil)
+	replaceBody(req, []byte("{}"))
+	doRetryRequest(t, config, req)
+	if *requests != 3 {
+		t.Errorf("expected a buffered body to be retried, got %v attempts", *requests)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, requests := flakyServer(1, http.StatusServiceUnavailable, http.Header{"Retry-After": []string{"1"}})
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	start := time.Now()
+	if statusCode := doRetryRequest(t, &RetryConfig{MaxAttempts: 2, InitialBackoffSeconds: 0.001}, req); statusCode != http.StatusOK {
+		t.Errorf("expected HTTP 200 after retrying, got %v", statusCode)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected Retry-After to be respected, retried after %v", elapsed)
+	}
+
+	// give up when Retry-After is longer than the max backoff
+	atomic.StoreInt64(requests, 0)
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	if statusCode := doRetryRequest(t, &RetryConfig{MaxAttempts: 2, MaxBackoffSeconds: 0.5}, req); statusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected HTTP 503 without retrying, got %v", statusCode)
+	}
+}
+
+func TestRetryConnectionErrors(t *testing.T) {
+	req, _ := http.NewRequest("GET", closedPortUrl(t, "http"), nil)
+	_, err := newRetryRoundTripper(http.DefaultTransport, &RetryConfig{MaxAttempts: 2, InitialBackoffSeconds: 0.001}, log.NewEntry(log.StandardLogger())).RoundTrip(req)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if reason := classifyRetryError(err); reason != RetryErrorConnect {
+		t.Errorf("expected a connect error, got %q (%v)", reason, err)
+	}
+
+	if err := (&RetryConfig{Errors: []string{"bogus"}}).Validate(); err == nil {
+		t.Error("expected unknown retry errors to be invalid")
+	}
+}
@@ -0,0 +1,315 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// secretReferencePattern matches ${env:NAME}, ${file:/path/to/secret} and ${exec:/path/to/helper args...}
+var secretReferencePattern = regexp.MustCompile(`\$\{(env|file|exec):([^}]+)\}`)
+
+// secretExecTTL is how long the output of an exec secret is reused before the command is run again
+const secretExecTTL = 5 * time.Minute
+
+const secretExecTimeout = 10 * time.Second
+
+// minRedactedSecretLength keeps short values (which are likely not secret) from being redacted everywhere they appear in logs
+const minRedactedSecretLength = 8
+
+// SecretString is a config value that may reference secrets, e.g. "Bearer ${env:GITHUB_TOKEN}".
+// References are resolved every time the value is used, and the value is always redacted when printed.
+type SecretString string
+
+func (ss SecretString) String() string {
+	return RedactedString
+}
+
+func (ss SecretString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ss.String())
+}
+
+func (ss SecretString) hasReferences() bool {
+	return secretReferencePattern.MatchString(string(ss))
+}
+
+func validateSecretReference(source string, argument string) error {
+	switch source {
+	case "file":
+		if !filepath.IsAbs(argument) {
+			return fmt.Errorf("file path %v must be absolute", argument)
+		}
+	case "exec":
+		if len(strings.Fields(argument)) == 0 {
+			return fmt.Errorf("no command")
+		}
+	}
+	return nil
+}
+
+func (ss SecretString) Validate() error {
+	for _, match := range secretReferencePattern.FindAllStringSubmatch(string(ss), -1) {
+		if err := validateSecretReference(match[1], strings.TrimSpace(match[2])); err != nil {
+			return fmt.Errorf("invalid secret reference %v: %v", match[0], err)
+		}
+	}
+	return nil
+}
+
+// checkReference makes sure a secret reference in a local config file is allowed
+func (config SecretsConfig) checkReference(source string, argument string) error {
+	if source == "exec" && !config.AllowExec {
+		return fmt.Errorf("exec secrets are disabled, set secrets.allowExec to enable them")
+	}
+	return validateSecretReference(source, argument)
+}
+
+// checkSecretReferences calls check for every secret reference in a decoded config value, and returns the first error
+func checkSecretReferences(value interface{}, check func(source string, argument string) error) error {
+	switch v := value.(type) {
+	case string:
+		for _, match := range secretReferencePattern.FindAllStringSubmatch(v, -1) {
+			if err := check(match[1], strings.TrimSpace(match[2])); err != nil {
+				return fmt.Errorf("secret reference %v: %v", match[0], err)
+			}
+		}
+	case map[string]interface{}:
+		for _, child := range v {
+			if err := checkSecretReferences(child, check); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for _, child := range v {
+			if err := checkSecretReferences(child, check); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := checkSecretReferences(child, check); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve replaces secret references with their current values
+func (ss SecretString) Resolve() (string, error) {
+	var resolveErr error
+	resolved := secretReferencePattern.ReplaceAllStringFunc(string(ss), func(reference string) string {
+		match := secretReferencePattern.FindStringSubmatch(reference)
+		value, err := secretSources.resolve(match[1], strings.TrimSpace(match[2]))
+		if err != nil {
+			if resolveErr == nil {
+				resolveErr = fmt.Errorf("failed to resolve %v: %v", reference, err)
+			}
+			return ""
+		}
+		RegisterSecret(value)
+		return value
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return resolved, nil
+}
+
+// ResolveSecretHeaders resolves every header value
+func ResolveSecretHeaders(headers map[string]SecretString) (map[string]string, error) {
+	resolved := make(map[string]string, len(headers))
+	for name, value := range headers {
+		resolvedValue, err := value.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("header %v: %v", name, err)
+		}
+		resolved[name] = resolvedValue
+	}
+	return resolved, nil
+}
+
+type fileSecret struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+type execSecret struct {
+	expiresAt time.Time
+	value     string
+}
+
+// secretSourceCache remembers file secrets until the file changes, and exec secrets until they expire
+type secretSourceCache struct {
+	mu    sync.Mutex
+	files map[string]fileSecret
+	execs map[string]execSecret
+}
+
+var secretSources = &secretSourceCache{
+	files: map[string]fileSecret{},
+	execs: map[string]execSecret{},
+}
+
+func (cache *secretSourceCache) resolve(source string, argument string) (string, error) {
+	switch source {
+	case "env":
+		value, exists := os.LookupEnv(argument)
+		if !exists {
+			return "", fmt.Errorf("environment variable %v is not set", argument)
+		}
+		return value, nil
+	case "file":
+		return cache.resolveFile(argument)
+	case "exec":
+		return cache.resolveExec(argument)
+	}
+	return "", fmt.Errorf("unknown secret source %v", source)
+}
+
+func (cache *secretSourceCache) resolveFile(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("file path %v must be absolute", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mu.Lock()
+	cached, exists := cache.files[path]
+	cache.mu.Unlock()
+	if exists && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.value, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(contents))
+	if exists {
+		log.WithField("path", path).Info("secret.file_reloaded")
+	}
+
+	cache.mu.Lock()
+	cache.files[path] = fileSecret{modTime: info.ModTime(), size: info.Size(), value: value}
+	cache.mu.Unlock()
+	return value, nil
+}
+
+func (cache *secretSourceCache) resolveExec(command string) (string, error) {
+	cache.mu.Lock()
+	cached, exists := cache.execs[command]
+	cache.mu.Unlock()
+	if exists && time.Now().Before(cached.expiresAt) {
+		return cached.value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+	defer cancel()
+
+	args := strings.Fields(command)
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		// don't include the output, which could contain part of the secret
+		return "", fmt.Errorf("command %v failed: %v", args[0], err)
+	}
+	value := strings.TrimSpace(string(output))
+
+	cache.mu.Lock()
+	cache.execs[command] = execSecret{expiresAt: time.Now().Add(secretExecTTL), value: value}
+	cache.mu.Unlock()
+	return value, nil
+}
+
+// secretValues holds every secret value that has been resolved, so the log hook can redact them
+var secretValues sync.Map
+
+// RegisterSecret marks a value as secret so that it's redacted from logs
+func RegisterSecret(value string) {
+	if len(value) >= minRedactedSecretLength {
+		secretValues.Store(value, struct{}{})
+	}
+}
+
+// registerLiteralSecret marks a secret that's written directly in the config, rather than referenced, for redaction
+func registerLiteralSecret(ss SecretString) {
+	if !ss.hasReferences() {
+		RegisterSecret(string(ss))
+	}
+}
+
+func redactSecrets(s string) (string, bool) {
+	redacted := false
+	secretValues.Range(func(key, _ interface{}) bool {
+		if secret := key.(string); strings.Contains(s, secret) {
+			s = strings.ReplaceAll(s, secret, RedactedString)
+			redacted = true
+		}
+		return true
+	})
+	return s, redacted
+}
+
+// SecretRedactionHook is a logrus hook that redacts resolved secret values from log messages and fields
+type SecretRedactionHook struct{}
+
+func (hook *SecretRedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire redacts string, error, []byte and http.Header fields. Other field types are left alone, since
+// formatting them would change how they're logged.
+func (hook *SecretRedactionHook) Fire(entry *log.Entry) error {
+	entry.Message, _ = redactSecrets(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key], _ = redactSecrets(v)
+		case error:
+			if redacted, changed := redactSecrets(v.Error()); changed {
+				entry.Data[key] = redacted
+			}
+		case []byte:
+			if redacted, changed := redactSecrets(string(v)); changed {
+				entry.Data[key] = []byte(redacted)
+			}
+		case http.Header:
+			entry.Data[key] = redactSecretHeaders(v)
+		}
+	}
+	return nil
+}
+
+// redactSecretHeaders returns the headers, or a redacted copy if any value contains a secret
+func redactSecretHeaders(headers http.Header) http.Header {
+	var redacted http.Header
+	for name, values := range headers {
+		for i, value := range values {
+			redactedValue, changed := redactSecrets(value)
+			if !changed {
+				continue
+			}
+			if redacted == nil {
+				redacted = headers.Clone()
+			}
+			redacted[name][i] = redactedValue
+		}
+	}
+	if redacted == nil {
+		return headers
+	}
+	return redacted
+}
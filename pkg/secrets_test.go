@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func assertResolvesTo(t *testing.T, ss SecretString, expected string) {
+	resolved, err := ss.Resolve()
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if resolved != expected {
+		t.Errorf("expected %q, got %q", expected, resolved)
+	}
+}
+
+func TestSecretStringEnv(t *testing.T) {
+	t.Setenv("TEST_SECRET_TOKEN", "glpat-0123456789")
+
+	assertResolvesTo(t, "Bearer ${env:TEST_SECRET_TOKEN}", "Bearer glpat-0123456789")
+	assertResolvesTo(t, "application/json", "application/json")
+
+	if _, err := SecretString("${env:TEST_SECRET_MISSING}").Resolve(); err == nil {
+		t.Error("expected an error for a missing environment variable")
+	}
+}
+
+func TestSecretStringFile(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(secretFile, []byte("first-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ss := SecretString(fmt.Sprintf("${file:%v}", secretFile))
+	assertResolvesTo(t, ss, "first-token")
+
+	// a rotated secret is picked up without restarting
+	if err := os.WriteFile(secretFile, []byte("second-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(secretFile, future, future)
+	assertResolvesTo(t, ss, "second-token")
+}
+
+func TestSecretStringExec(t *testing.T) {
+	assertResolvesTo(t, "${exec:echo exec-token}", "exec-token")
+
+	if _, err := SecretString("${exec:/nonexistent/cred-helper}").Resolve(); err == nil {
+		t.Error("expected an error for a failing command")
+	}
+}
+
+func TestSecretStringRedaction(t *testing.T) {
+	t.Setenv("TEST_SECRET_TOKEN", "ghp_redactme0123456789")
+	ss := SecretString("Bearer ${env:TEST_SECRET_TOKEN}")
+
+	output, _ := json.Marshal(map[string]SecretString{"Authorization": ss})
+	if string(output) != `{"Authorization":"REDACTED"}` {
+		t.Errorf("expected the secret to be redacted in JSON, got %v", string(output))
+	}
+	if fmt.Sprint(ss) != RedactedString {
+		t.Errorf("expected the secret to be redacted when printed, got %v", fmt.Sprint(ss))
+	}
+
+	resolved, _ := ss.Resolve()
+
+	buf := &bytes.Buffer{}
+	logger := log.New()
+	logger.SetOutput(buf)
+	logger.AddHook(&SecretRedactionHook{})
+	headers := http.Header{"Authorization": {resolved}}
+	logger.WithField("request_headers", headers).WithError(fmt.Errorf("failed with %v", resolved)).Info("sent " + resolved)
+
+	if strings.Contains(buf.String(), "ghp_redactme0123456789") {
+		t.Errorf("expected the secret to be redacted from logs, got %v", buf.String())
+	}
+	if headers.Get("Authorization") != resolved {
+		t.Error("expected the logged headers not to be modified")
+	}
+
+	// other field types keep their type
+	entry := log.NewEntry(logger).WithField("status", 200).WithField("params", map[string]string{"token": resolved})
+	(&SecretRedactionHook{}).Fire(entry)
+	if entry.Data["status"] != 200 {
+		t.Errorf("expected non-string fields to be left alone, got %#v", entry.Data["status"])
+	}
+	if _, ok := entry.Data["params"].(map[string]string); !ok {
+		t.Errorf("expected non-string fields to be left alone, got %#v", entry.Data["params"])
+	}
+}
+
+func TestSecretReferencesInConfig(t *testing.T) {
+	dir := t.TempDir()
+	load := func(contents string) error {
+		path := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig([]string{path}, 0)
+		return err
+	}
+
+	execConfig := `
+inbound:
+  allowlist:
+    - url: https://jira.example.com/rest/api/2/issue
+      methods: [POST]
+      setRequestHeaders:
+        Authorization: "Bearer ${exec:/usr/local/bin/cred-helper jira}"
+`
+	if err := load(execConfig); err == nil || !strings.Contains(err.Error(), "secrets.allowExec") {
+		t.Errorf("expected exec secrets to be rejected without secrets.allowExec, got %v", err)
+	}
+	if err := load(execConfig + "secrets:\n  allowExec: true\n"); err != nil {
+		t.Errorf("expected exec secrets to be allowed with secrets.allowExec: %v", err)
+	}
+
+	if err := load("inbound:\n  gitlab:\n    baseUrl: https://gitlab.example.com/api/v4\n    token: ${file:secrets/gitlab-token}\n"); err == nil || !strings.Contains(err.Error(), "must be absolute") {
+		t.Errorf("expected a relative file secret to be rejected, got %v", err)
+	}
+	if _, err := SecretString("${file:secrets/gitlab-token}").Resolve(); err == nil {
+		t.Error("expected a relative file secret not to be resolved")
+	}
+}
+
+func TestDefaultConfigSecretReferences(t *testing.T) {
+	merge := func(contents string) error {
+		return mergeDefaultConfig(viper.New(), []byte(contents))
+	}
+
+	if err := merge(`{"inbound": {"allowlist": [{"url": "https://git.example.com/api", "methods": ["GET"]}]}}`); err != nil {
+		t.Errorf("expected the default config to be merged: %v", err)
+	}
+
+	rejected := []string{
+		`{"inbound": {"allowlist": [{"url": "https://evil.example.com/", "methods": ["GET"], "setRequestHeaders": {"X-Key": "${file:/etc/shadow}"}}]}}`,
+		`{"inbound": {"gitlab": {"baseUrl": "https://gitlab.example.com/api/v4", "token": "${exec:/bin/sh -c id}"}}}`,
+		`{"inbound": {"github": {"token": "${env:GITHUB_TOKEN}"}}}`,
+		`{"inbound": {"github": {"token": "\u0024{file:/etc/shadow}"}}}`,
+	}
+	for _, contents := range rejected {
+		if err := merge(contents); err == nil {
+			t.Errorf("expected secret references in the default config to be rejected: %v", contents)
+		}
+	}
+}
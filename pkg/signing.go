@@ -0,0 +1,354 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+const sigV4UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// defaultSigningMaxBodyBytes limits how much of a request body is buffered so that it can be signed
+const defaultSigningMaxBodyBytes = 10 * 1024 * 1024
+
+const defaultHMACSignatureHeader = "X-Signature"
+const defaultHMACTimestampHeader = "X-Signature-Timestamp"
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+var hmacEncodings = []string{"hex", "base64"}
+
+// SigningError is returned when a request can't be signed, e.g. because a key couldn't be resolved
+type SigningError struct {
+	Err error
+}
+
+func (e *SigningError) Error() string {
+	return fmt.Sprintf("failed to sign request: %v", e.Err)
+}
+
+func (e *SigningError) Unwrap() error {
+	return e.Err
+}
+
+// SigningBodyTooLargeError is returned when a request body is too large to be buffered for signing
+type SigningBodyTooLargeError struct {
+	Limit int64
+}
+
+func (e *SigningBodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body is larger than %v bytes", e.Limit)
+}
+
+// requestSigner adds a signature to a request. body is nil if the payload isn't signed.
+type requestSigner interface {
+	sign(req *http.Request, body []byte, now time.Time) error
+}
+
+func (config *SigningConfig) Validate() error {
+	if config == nil {
+		return nil
+	}
+	if (config.SigV4 == nil) == (config.HMAC == nil) {
+		return fmt.Errorf("signing must set exactly one of sigv4 or hmac")
+	}
+	return nil
+}
+
+func (config *SigningConfig) maxBodyBytes() int64 {
+	if config.MaxBodyBytes == 0 {
+		return defaultSigningMaxBodyBytes
+	}
+	return config.MaxBodyBytes
+}
+
+func (config *SigningConfig) signer() requestSigner {
+	if config.SigV4 != nil {
+		return config.SigV4
+	}
+	return config.HMAC
+}
+
+func (config *SigV4Config) Validate() error {
+	if config == nil {
+		return nil
+	}
+	if config.Service == "" || config.Region == "" {
+		return fmt.Errorf("sigv4 service and region are required")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return fmt.Errorf("sigv4 accessKeyId and secretAccessKey are required")
+	}
+	return nil
+}
+
+func (config *HMACSigningConfig) Validate() error {
+	if config == nil {
+		return nil
+	}
+	if config.Key == "" {
+		return fmt.Errorf("hmac key is required")
+	}
+	if _, exists := hmacAlgorithms[config.algorithm()]; !exists {
+		return fmt.Errorf("unknown hmac algorithm %v (expected sha256 or sha512)", config.Algorithm)
+	}
+	if !stringInSlice(config.encoding(), hmacEncodings) {
+		return fmt.Errorf("unknown hmac encoding %v (expected one of %v)", config.Encoding, hmacEncodings)
+	}
+	return nil
+}
+
+func (config *HMACSigningConfig) algorithm() string {
+	if config.Algorithm == "" {
+		return "sha256"
+	}
+	return strings.ToLower(config.Algorithm)
+}
+
+func (config *HMACSigningConfig) encoding() string {
+	if config.Encoding == "" {
+		return "hex"
+	}
+	return config.Encoding
+}
+
+func (config *HMACSigningConfig) signatureHeader() string {
+	if config.SignatureHeader == "" {
+		return defaultHMACSignatureHeader
+	}
+	return config.SignatureHeader
+}
+
+func (config *HMACSigningConfig) timestampHeader() string {
+	if config.TimestampHeader == "" {
+		return defaultHMACTimestampHeader
+	}
+	return config.TimestampHeader
+}
+
+func hmacSum(newHash func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode percent-encodes everything except unreserved characters, as required by SigV4
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalPath normalizes the percent-encoding of the request path. Path segments are encoded twice, except for S3.
+func canonicalPath(u *url.URL, doubleEncode bool) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			unescaped = segment
+		}
+		segments[i] = uriEncode(unescaped, true)
+		if doubleEncode {
+			segments[i] = uriEncode(segments[i], true)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts the query params by name and then value
+func canonicalQuery(u *url.URL) string {
+	var params []string
+	for name, values := range u.Query() {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// sign implements AWS Signature Version 4 (https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html)
+func (config *SigV4Config) sign(req *http.Request, body []byte, now time.Time) error {
+	accessKeyId, err := config.AccessKeyID.Resolve()
+	if err != nil {
+		return err
+	}
+	secretAccessKey, err := config.SecretAccessKey.Resolve()
+	if err != nil {
+		return err
+	}
+	sessionToken, err := config.SessionToken.Resolve()
+	if err != nil {
+		return err
+	}
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, config.Region, config.Service, "aws4_request"}, "/")
+
+	payloadHash := sigV4UnsignedPayload
+	if !config.UnsignedPayload {
+		payloadHash = sha256Hex(body)
+	}
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if config.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// sign the host, content headers and x-amz-* headers, which intermediaries shouldn't change
+	signedValues := map[string]string{"host": requestHost(req)}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			signedValues[name] = strings.Join(values, ",")
+		}
+	}
+	signedHeaders := make([]string, 0, len(signedValues))
+	for name := range signedValues {
+		signedHeaders = append(signedHeaders, name)
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(signedValues[name]), " ") + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL, config.Service != "s3"),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, config.Region, config.Service, "aws4_request"} {
+		key = hmacSum(sha256.New, key, part)
+	}
+	signature := hex.EncodeToString(hmacSum(sha256.New, key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v", sigV4Algorithm, accessKeyId, scope, strings.Join(signedHeaders, ";"), signature))
+	return nil
+}
+
+// canonicalRequest is the string that's signed: the timestamp, method, path, sorted query, signed headers (as name:value) and the hex SHA-256 of the body, one per line
+func (config *HMACSigningConfig) canonicalRequest(req *http.Request, body []byte, timestamp string) string {
+	lines := []string{timestamp, req.Method, canonicalPath(req.URL, false), canonicalQuery(req.URL)}
+	for _, name := range config.SignedHeaders {
+		value := req.Header.Get(name)
+		if strings.EqualFold(name, "host") {
+			value = requestHost(req)
+		}
+		lines = append(lines, strings.ToLower(name)+":"+strings.TrimSpace(value))
+	}
+	lines = append(lines, sha256Hex(body))
+	return strings.Join(lines, "\n")
+}
+
+func (config *HMACSigningConfig) sign(req *http.Request, body []byte, now time.Time) error {
+	key, err := config.Key.Resolve()
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(config.timestampHeader(), timestamp)
+
+	signature := hmacSum(hmacAlgorithms[config.algorithm()], []byte(key), config.canonicalRequest(req, body, timestamp))
+	if config.encoding() == "base64" {
+		req.Header.Set(config.signatureHeader(), base64.StdEncoding.EncodeToString(signature))
+	} else {
+		req.Header.Set(config.signatureHeader(), hex.EncodeToString(signature))
+	}
+	return nil
+}
+
+type signingRoundTripper struct {
+	transport    http.RoundTripper
+	signer       requestSigner
+	unsignedBody bool
+	maxBodyBytes int64
+}
+
+// newSigningRoundTripper wraps the transport so that every attempt is signed after all other headers have been set
+func newSigningRoundTripper(transport http.RoundTripper, config *SigningConfig) http.RoundTripper {
+	if config == nil {
+		return transport
+	}
+	return &signingRoundTripper{
+		transport:    transport,
+		signer:       config.signer(),
+		unsignedBody: config.SigV4 != nil && config.SigV4.UnsignedPayload,
+		maxBodyBytes: config.maxBodyBytes(),
+	}
+}
+
+func (rt *signingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	signedReq := req.Clone(req.Context())
+
+	var body []byte
+	if !rt.unsignedBody && req.Body != nil && req.Body != http.NoBody {
+		// read one extra byte so oversized bodies can be detected
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, rt.maxBodyBytes+1))
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > rt.maxBodyBytes {
+			return nil, &SigningError{Err: &SigningBodyTooLargeError{Limit: rt.maxBodyBytes}}
+		}
+		replaceBody(signedReq, body)
+	}
+
+	if err := rt.signer.sign(signedReq, body, time.Now()); err != nil {
+		return nil, &SigningError{Err: err}
+	}
+	return rt.transport.RoundTrip(signedReq)
+}
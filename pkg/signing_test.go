@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test vectors from the AWS SigV4 test suite
+func TestSigV4(t *testing.T) {
+	config := &SigV4Config{
+		Service:         "service",
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		url       string
+		signature string
+	}{
+		{"https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		if err := config.sign(req, nil, now); err != nil {
+			t.Fatal(err)
+		}
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + test.signature
+		if authorization := req.Header.Get("Authorization"); authorization != expected {
+			t.Errorf("%v: expected %v, got %v", test.url, expected, authorization)
+		}
+	}
+}
+
+func TestSigV4S3PayloadHash(t *testing.T) {
+	config := &SigV4Config{Service: "s3", Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+	req, _ := http.NewRequest("PUT", "https://minio.example.com/artifacts/report.json", nil)
+	config.sign(req, []byte("{}"), time.Now())
+
+	if req.Header.Get("X-Amz-Content-Sha256") != sha256Hex([]byte("{}")) {
+		t.Errorf("expected the payload hash header, got %v", req.Header.Get("X-Amz-Content-Sha256"))
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date") {
+		t.Errorf("expected the payload hash to be signed, got %v", req.Header.Get("Authorization"))
+	}
+}
+
+func TestHMACSigningRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodyHash := sha256.Sum256(body)
+		canonical := strings.Join([]string{
+			r.Header.Get("X-Signature-Timestamp"),
+			"POST",
+			"/hooks/semgrep",
+			"a=1&b=2",
+			"content-type:application/json",
+			hex.EncodeToString(bodyHash[:]),
+		}, "\n")
+		mac := hmac.New(sha256.New, []byte("webhook-key"))
+		mac.Write([]byte(canonical))
+		if r.Header.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	transport := newSigningRoundTripper(http.DefaultTransport, &SigningConfig{HMAC: &HMACSigningConfig{Key: "webhook-key", SignedHeaders: []string{"Content-Type"}}})
+	req, _ := http.NewRequest("POST", server.URL+"/hooks/semgrep?b=2&a=1", strings.NewReader(`{"event": "finding"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"event": "finding"}` {
+		t.Errorf("expected a valid signature and an intact body, got HTTP %v: %v", resp.StatusCode, string(body))
+	}
+	if req.Header.Get("X-Signature") != "" {
+		t.Error("expected the original request to be left unmodified")
+	}
+}
+
+func TestSigningError(t *testing.T) {
+	transport := newSigningRoundTripper(http.DefaultTransport, &SigningConfig{HMAC: &HMACSigningConfig{Key: "${env:TEST_MISSING_SIGNING_KEY}"}})
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1/", nil)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Error("expected a signing error")
+	} else if _, ok := err.(*SigningError); !ok {
+		t.Errorf("expected a SigningError, got %v", err)
+	}
+}
+
+func TestSigningBodyTooLarge(t *testing.T) {
+	transport := newSigningRoundTripper(http.DefaultTransport, &SigningConfig{HMAC: &HMACSigningConfig{Key: "webhook-key"}, MaxBodyBytes: 16})
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:1/", strings.NewReader(`{"event": "finding"}`))
+	_, err := transport.RoundTrip(req)
+	var tooLargeErr *SigningBodyTooLargeError
+	if !errors.As(err, &tooLargeErr) || tooLargeErr.Limit != 16 {
+		t.Errorf("expected a SigningBodyTooLargeError, got %v", err)
+	}
+}
@@ -126,5 +126,14 @@ func (config *WireguardBase) Start() (*netstack.Net, func() error, error) {
 		return nil, nil, fmt.Errorf("failed to bring up wireguard device: %v", err)
 	}
 
-	return tnet, dev.Down, nil
+	// poll peer stats, so that the state of the tunnel can be monitored
+	config.monitor = newWireguardMonitor(config.Stats, dev.IpcGet)
+	go config.monitor.run()
+
+	teardown := func() error {
+		config.monitor.stop()
+		return dev.Down()
+	}
+
+	return tnet, teardown, nil
 }
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var wireguardHandshakeAgeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "wireguard_peer_last_handshake_age_seconds",
+	Help:      "Time since the last WireGuard handshake with each peer, or since the tunnel came up if there hasn't been one",
+}, []string{"public_key"})
+
+var wireguardReceivedBytesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "wireguard_peer_received_bytes",
+	Help:      "Number of bytes received from each WireGuard peer",
+}, []string{"public_key"})
+
+var wireguardSentBytesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "wireguard_peer_sent_bytes",
+	Help:      "Number of bytes sent to each WireGuard peer",
+}, []string{"public_key"})
+
+var wireguardPeerInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "wireguard_peer_info",
+	Help:      "Current endpoint of each WireGuard peer (always 1)",
+}, []string{"public_key", "endpoint"})
+
+// WireguardPeerStats is the state of a peer as reported by the WireGuard device
+type WireguardPeerStats struct {
+	PublicKey     string    `json:"publicKey"`
+	Endpoint      string    `json:"endpoint"`
+	LastHandshake time.Time `json:"lastHandshake"`
+	ReceivedBytes int64     `json:"receivedBytes"`
+	SentBytes     int64     `json:"sentBytes"`
+}
+
+// HandshakeAge returns the time since the last handshake, or since the given start time if there hasn't been one
+func (stats WireguardPeerStats) HandshakeAge(now time.Time, start time.Time) time.Duration {
+	if stats.LastHandshake.IsZero() {
+		return now.Sub(start)
+	}
+	return now.Sub(stats.LastHandshake)
+}
+
+// parseWireguardStats parses the peers out of the output of a UAPI get operation
+func parseWireguardStats(uapi string) []WireguardPeerStats {
+	var peers []WireguardPeerStats
+	var handshakeSec, handshakeNsec int64
+
+	finishPeer := func() {
+		if len(peers) > 0 && (handshakeSec != 0 || handshakeNsec != 0) {
+			peers[len(peers)-1].LastHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(uapi))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			finishPeer()
+			publicKey, err := hex.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			peers = append(peers, WireguardPeerStats{PublicKey: base64.StdEncoding.EncodeToString(publicKey)})
+			continue
+		}
+		// device level keys (including the private key) come before the first peer
+		if len(peers) == 0 {
+			continue
+		}
+		peer := &peers[len(peers)-1]
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "last_handshake_time_sec":
+			handshakeSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.ReceivedBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "tx_bytes":
+			peer.SentBytes, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	finishPeer()
+	return peers
+}
+
+// wireguardMonitor periodically polls the WireGuard device for peer stats
+type wireguardMonitor struct {
+	config WireguardStatsConfig
+	ipcGet func() (string, error)
+	start  time.Time
+	done   chan struct{}
+}
+
+func newWireguardMonitor(config WireguardStatsConfig, ipcGet func() (string, error)) *wireguardMonitor {
+	return &wireguardMonitor{config: config, ipcGet: ipcGet, start: time.Now(), done: make(chan struct{})}
+}
+
+func (monitor *wireguardMonitor) run() {
+	ticker := time.NewTicker(time.Duration(monitor.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	monitor.poll(time.Now())
+	for {
+		select {
+		case <-monitor.done:
+			return
+		case now := <-ticker.C:
+			monitor.poll(now)
+		}
+	}
+}
+
+func (monitor *wireguardMonitor) stop() {
+	close(monitor.done)
+}
+
+func (monitor *wireguardMonitor) poll(now time.Time) {
+	peers, err := monitor.currentStats()
+	if err != nil {
+		log.WithError(err).Warn("wireguard.stats_error")
+		return
+	}
+
+	wireguardPeerInfoGauge.Reset()
+	for _, peer := range peers {
+		age := peer.HandshakeAge(now, monitor.start)
+		wireguardHandshakeAgeGauge.WithLabelValues(peer.PublicKey).Set(age.Seconds())
+		wireguardReceivedBytesGauge.WithLabelValues(peer.PublicKey).Set(float64(peer.ReceivedBytes))
+		wireguardSentBytesGauge.WithLabelValues(peer.PublicKey).Set(float64(peer.SentBytes))
+		wireguardPeerInfoGauge.WithLabelValues(peer.PublicKey, peer.Endpoint).Set(1)
+
+		logger := log.WithFields(log.Fields{
+			"public_key":                 peer.PublicKey,
+			"endpoint":                   peer.Endpoint,
+			"last_handshake_age_seconds": int64(age.Seconds()),
+			"rx_bytes":                   peer.ReceivedBytes,
+			"tx_bytes":                   peer.SentBytes,
+		})
+		logger.Info("wireguard.peer_stats")
+		if monitor.config.HandshakeWarningSeconds > 0 && age > time.Duration(monitor.config.HandshakeWarningSeconds)*time.Second {
+			logger.Warn("wireguard.handshake_stale")
+		}
+	}
+}
+
+// currentStats asks the device for the current peer stats, rather than waiting for the next poll
+func (monitor *wireguardMonitor) currentStats() ([]WireguardPeerStats, error) {
+	uapi, err := monitor.ipcGet()
+	if err != nil {
+		return nil, err
+	}
+	return parseWireguardStats(uapi), nil
+}
@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+const testWireguardUAPI = `private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a
+listen_port=51820
+public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33
+endpoint=192.95.5.67:1234
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=500000000
+tx_bytes=38333
+rx_bytes=2224
+persistent_keepalive_interval=20
+allowed_ip=fdf0:59dc:33cf:9be8::/64
+public_key=58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376
+tx_bytes=148
+rx_bytes=0
+persistent_keepalive_interval=20
+allowed_ip=10.0.0.1/32
+errno=0
+`
+
+func TestParseWireguardStats(t *testing.T) {
+	peers := parseWireguardStats(testWireguardUAPI)
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %+v", peers)
+	}
+
+	first := peers[0]
+	if first.PublicKey != "uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=" || first.Endpoint != "192.95.5.67:1234" || first.ReceivedBytes != 2224 || first.SentBytes != 38333 {
+		t.Errorf("unexpected stats for first peer: %+v", first)
+	}
+	if !first.LastHandshake.Equal(time.Unix(1700000000, 500000000)) {
+		t.Errorf("unexpected last handshake: %v", first.LastHandshake)
+	}
+
+	second := peers[1]
+	if !second.LastHandshake.IsZero() || second.Endpoint != "" || second.SentBytes != 148 {
+		t.Errorf("unexpected stats for second peer: %+v", second)
+	}
+
+	// a peer that's never completed a handshake is as stale as the tunnel is old
+	start := time.Unix(1700000000, 0)
+	if age := second.HandshakeAge(start.Add(time.Minute), start); age != time.Minute {
+		t.Errorf("expected handshake age of 1m, got %v", age)
+	}
+}